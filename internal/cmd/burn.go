@@ -13,7 +13,6 @@ import (
 	"time"
 
 	"github.com/fcjr/sprout/internal/burn"
-	"github.com/fcjr/sprout/internal/nix"
 	"github.com/spf13/cobra"
 )
 
@@ -72,7 +71,16 @@ func runBurn(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return fmt.Errorf("failed to get image file info: %w", err)
 	}
-	fmt.Printf("%sImage size: %s%s\n\n", Bold, burn.FormatBytes(imageInfo.Size()), Reset)
+	fmt.Printf("%sImage size: %s%s\n", Bold, burn.FormatBytes(imageInfo.Size()), Reset)
+
+	requiredSize, err := requiredCardSize(imagePath)
+	if err != nil {
+		return err
+	}
+	if requiredSize > imageInfo.Size() {
+		fmt.Printf("%sCard size needed: %s%s\n", Bold, burn.FormatBytes(requiredSize), Reset)
+	}
+	fmt.Println()
 
 	// Detect available disks
 	fmt.Printf("%sDetecting available storage devices...\n", Bold)
@@ -105,6 +113,12 @@ func runBurn(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	// Partitions added on first boot have to fit as well
+	if selectedDisk.SizeBytes != 0 && uint64(requiredSize) > selectedDisk.SizeBytes {
+		return fmt.Errorf("%s (%s) is too small: the image and its partitions need %s",
+			selectedDisk.Device, selectedDisk.Size, burn.FormatBytes(requiredSize))
+	}
+
 	// Final confirmation
 	if !force {
 		fmt.Printf("\n%s⚠️  WARNING: This will completely erase all data on %s (%s)%s\n",
@@ -158,25 +172,20 @@ func findImageFile(args []string) (string, error) {
 	}
 
 	// First, try to read sprout.yaml to get the configured output path
-	cwd, err := os.Getwd()
+	sproutFile, err := findConfigFile()
 	if err != nil {
-		return "", fmt.Errorf("failed to get current working directory: %w", err)
+		return "", err
 	}
 
-	sproutFile := filepath.Join(cwd, "sprout.yaml")
-	if _, err := os.Stat(sproutFile); err == nil {
+	if sproutFile != "" {
 		// sprout.yaml exists, try to load it (lightweight - no Docker processing)
-		nixInstance := &nix.Nix{}
+		nixInstance := newNix(false)
 		config, err := nixInstance.LoadConfigOnly(sproutFile)
 		if err != nil {
-			fmt.Printf("%sWarning: Found sprout.yaml but failed to load it: %v%s\n", Yellow, err, Reset)
-		} else if config.Output.Path != "" {
+			fmt.Printf("%sWarning: Found %s but failed to load it: %v%s\n", Yellow, filepath.Base(sproutFile), err, Reset)
+		} else {
 			// Check if the configured output path exists
 			outputPath := config.Output.Path
-			if !filepath.IsAbs(outputPath) {
-				outputPath = filepath.Join(cwd, outputPath)
-			}
-
 			if _, err := os.Stat(outputPath); err == nil {
 				fmt.Printf("%sUsing image from sprout.yaml: %s%s\n", Green, outputPath, Reset)
 				return filepath.Abs(outputPath)
@@ -232,6 +241,35 @@ func findImageFile(args []string) (string, error) {
 	return filepath.Abs(imgFiles[choice-1].Name())
 }
 
+// requiredCardSize returns how large a card has to be for the image. The
+// partition layout is taken from sprout.yaml when the image is the one it
+// builds.
+func requiredCardSize(imagePath string) (int64, error) {
+	imageInfo, err := os.Stat(imagePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get image file info: %w", err)
+	}
+
+	sproutFile, err := findConfigFile()
+	if err != nil || sproutFile == "" {
+		return imageInfo.Size(), nil
+	}
+	nixInstance := newNix(false)
+	config, err := nixInstance.LoadConfigOnly(sproutFile)
+	if err != nil {
+		return imageInfo.Size(), nil
+	}
+	if config.Output.Path != imagePath {
+		return imageInfo.Size(), nil
+	}
+
+	size, err := config.Image.RequiredSize(imagePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check the image partitions: %w", err)
+	}
+	return size, nil
+}
+
 func selectDisk(disks []burn.DiskInfo) (*burn.DiskInfo, error) {
 	reader := bufio.NewReader(os.Stdin)
 
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fcjr/sprout/internal/nix"
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration",
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the effective configuration and where each value comes from",
+	Long: `Show prints the configuration as it is built: the config file with the files
+it extends, the overlays given with --overlay and the device given with
+--device merged in. Every value is commented with the file and line it
+came from.`,
+	Args: cobra.NoArgs,
+	RunE: runConfigShow,
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd)
+}
+
+func runConfigShow(cmd *cobra.Command, args []string) error {
+	sproutFile, err := configFile()
+	if err != nil {
+		return err
+	}
+	config, err := newNix(false).EffectiveConfig(sproutFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", filepath.Base(sproutFile), err)
+	}
+	_, err = os.Stdout.Write(config)
+	return err
+}
+
+// configNames are the config files looked for in the current directory,
+// in order.
+var configNames = []string{"sprout.yaml", "sprout.yml", "sprout.json"}
+
+// configFlag, deviceFlag and overlayFlags are the --config, --device and
+// --overlay flags.
+var (
+	configFlag   string
+	deviceFlag   string
+	overlayFlags []string
+)
+
+// newNix returns a Nix for the device and overlays given on the command
+// line.
+func newNix(hermetic bool) *nix.Nix {
+	return &nix.Nix{Hermetic: hermetic, Device: deviceFlag, Overlays: overlayFlags}
+}
+
+// configFile returns the absolute path of the config file to use: the
+// --config flag, then $SPROUT_CONFIG, then the first of configNames in the
+// current directory.
+func configFile() (string, error) {
+	filename, err := findConfigFile()
+	if err != nil {
+		return "", err
+	}
+	if filename == "" {
+		cwd, _ := os.Getwd()
+		return "", fmt.Errorf("no sprout.yaml found in %s (use --config to choose a file)", cwd)
+	}
+	return filename, nil
+}
+
+// findConfigFile is like configFile but returns an empty path, rather than
+// an error, when the current directory has no config file.
+func findConfigFile() (string, error) {
+	filename := configFlag
+	if filename == "" {
+		filename = os.Getenv("SPROUT_CONFIG")
+	}
+	if filename != "" {
+		if _, err := os.Stat(filename); err != nil {
+			return "", fmt.Errorf("config file %s not found", filename)
+		}
+		return filepath.Abs(filename)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to get current working directory: %w", err)
+	}
+	for _, name := range configNames {
+		filename := filepath.Join(cwd, name)
+		if _, err := os.Stat(filename); err == nil {
+			return filename, nil
+		}
+	}
+	return "", nil
+}
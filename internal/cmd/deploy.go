@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fcjr/sprout/internal/deploy"
+	"github.com/fcjr/sprout/internal/discovery"
+	"github.com/fcjr/sprout/internal/nix"
+	"github.com/spf13/cobra"
+)
+
+var deployCmd = &cobra.Command{
+	Use:   "deploy <node>",
+	Short: "Push updated compose stacks to a running Sprout node",
+	Long: `Deploy resolves the compose stacks in sprout.yaml the same way seed does and
+installs them on a running node over SSH, without re-flashing the SD card.
+
+Only image layers the node does not have yet are sent. The stack is restarted
+and has to become healthy; otherwise the previous version is restored.
+
+The node can be given as host, user@host, or the name of a node found with
+'sprout discover'. The node must run an image built with deploy support.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runDeploy,
+}
+
+func init() {
+	rootCmd.AddCommand(deployCmd)
+	deployCmd.Flags().StringSlice("stack", nil, "Stacks to deploy (defaults to all enabled stacks)")
+	deployCmd.Flags().Int("port", 22, "SSH port of the node")
+	deployCmd.Flags().Bool("hermetic", false, "Refuse build host environment variables when resolving the compose project")
+}
+
+func runDeploy(cmd *cobra.Command, args []string) error {
+	stackNames, _ := cmd.Flags().GetStringSlice("stack")
+	port, _ := cmd.Flags().GetInt("port")
+	hermetic, _ := cmd.Flags().GetBool("hermetic")
+
+	fmt.Printf("\n%s%s🚀 Sprout Deploy%s\n", Bold, Green, Reset)
+	fmt.Printf("%s%s═══════════════════════════════%s\n\n", Bold, Green, Reset)
+
+	sproutFile, err := configFile()
+	if err != nil {
+		return printError("%w", err)
+	}
+
+	printStep("Resolving compose stacks...")
+	nixInstance := newNix(hermetic)
+	defer nixInstance.Close()
+	config, err := nixInstance.LoadDeployConfig(sproutFile, stackNames)
+	if config != nil && config.Secrets.Path != "" {
+		defer os.RemoveAll(config.Secrets.Path)
+	}
+	if err != nil {
+		return printError("failed to load configuration from %s: %w", filepath.Base(sproutFile), err)
+	}
+
+	var stacks []nix.DockerComposeConfig
+	for _, stack := range config.DockerCompose.Enabled() {
+		if stack.ModifiedContent != "" {
+			stacks = append(stacks, stack)
+		}
+	}
+	if len(stacks) == 0 {
+		return printError("no docker_compose stacks to deploy")
+	}
+	printSuccess(fmt.Sprintf("%d stack(s), %d image(s)", len(stacks), len(config.Images)))
+
+	printStep(fmt.Sprintf("Connecting to %s...", args[0]))
+	target, err := resolveNode(args[0], config.Username)
+	if err != nil {
+		return printError("%w", err)
+	}
+	remote := deploy.NewRemote(target, port)
+	defer remote.Close()
+	if err := remote.Run("true", nil, nil); err != nil {
+		return printError("failed to connect to %s: %w", target, err)
+	}
+	printSuccess(fmt.Sprintf("Connected to %s", target))
+
+	deployer := &deploy.Deployer{Remote: remote}
+
+	printStep("Sending images...")
+	existing, err := deployer.ExistingLayers()
+	if err != nil {
+		return printError("%w", err)
+	}
+	for _, img := range config.Images {
+		printSubStep(fmt.Sprintf("Loading %s", img.Name))
+		sent, err := deployer.LoadImage(img, existing)
+		if err != nil {
+			return printError("%w", err)
+		}
+		printSuccess(fmt.Sprintf("%s: %d new layer(s)", img.Name, sent))
+	}
+
+	for _, stack := range stacks {
+		printStep(fmt.Sprintf("Deploying stack %s...", stack.Name))
+		if err := deployer.UploadStack(stack); err != nil {
+			return printError("%w", err)
+		}
+		printSubStep("Waiting for containers to become healthy...")
+		if err := deployer.Activate(stack); err != nil {
+			return printError("%w", err)
+		}
+		printSuccess(fmt.Sprintf("Stack %s is up", stack.Name))
+	}
+
+	fmt.Printf("\n%s%sDeploy Complete!%s\n", Bold, Green, Reset)
+	return nil
+}
+
+// resolveNode turns a node argument into an ssh target. Names that do not
+// resolve through DNS are looked up with mDNS discovery.
+func resolveNode(node, username string) (string, error) {
+	user, host, hasUser := strings.Cut(node, "@")
+	if !hasUser {
+		user, host = username, node
+	}
+
+	if net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			found, err := discovery.Find(ctx, host)
+			if err != nil {
+				return "", err
+			}
+			host = found.IP.String()
+		}
+	}
+
+	return user + "@" + host, nil
+}
@@ -0,0 +1,521 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fcjr/sprout/internal/nix"
+	"github.com/spf13/cobra"
+)
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create a sprout.yaml in the current directory, or at --config",
+	Long: `Init asks a few questions and writes a commented sprout.yaml, along with a
+.gitignore entry for the build output:
+
+  - an existing docker-compose file in the directory is offered for embedding
+  - public keys from ~/.ssh/*.pub are offered for SSH access
+  - wireless networks, the board and the username are asked for
+
+With --non-interactive nothing is asked and the flags are used instead, with
+every key in ~/.ssh/*.pub if no --ssh-key is given.`,
+	Args: cobra.NoArgs,
+	RunE: runInit,
+}
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+	initCmd.Flags().Bool("non-interactive", false, "Do not ask questions; take the answers from flags")
+	initCmd.Flags().Bool("force", false, "Overwrite an existing sprout.yaml")
+	initCmd.Flags().StringArray("ssh-key", nil, "Public key, or file holding one, allowed to log in (repeatable)")
+	initCmd.Flags().StringArray("wifi", nil, "Wireless network as SSID=passphrase (repeatable)")
+	initCmd.Flags().String("board", initBoards[0].Name, "Board the image is for: "+boardNames())
+	initCmd.Flags().String("username", "sprout", "Account the SSH keys log in as")
+	initCmd.Flags().String("compose", "", "Compose file to embed (defaults to the one found in the directory)")
+	initCmd.Flags().Bool("no-compose", false, "Do not embed a compose file")
+	initCmd.Flags().Bool("autodiscovery", true, "Advertise the device over mDNS for 'sprout discover'")
+}
+
+// initBoard is a board sprout init can set up for. Every board boots the
+// same aarch64 SD card image; the board decides what is asked.
+type initBoard struct {
+	Name        string
+	Description string
+	Wireless    bool
+}
+
+var initBoards = []initBoard{
+	{Name: "rpi4", Description: "Raspberry Pi 4, 400 or Compute Module 4", Wireless: true},
+	{Name: "rpi3", Description: "Raspberry Pi 3", Wireless: true},
+	{Name: "generic", Description: "Other aarch64 board booting U-Boot from an SD card"},
+}
+
+func boardNames() string {
+	names := make([]string, len(initBoards))
+	for i, board := range initBoards {
+		names[i] = board.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// composeFileNames are the files docker compose looks for, in its order.
+var composeFileNames = []string{"compose.yaml", "compose.yml", "docker-compose.yaml", "docker-compose.yml"}
+
+var usernamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// initAnswers is what sprout.yaml is written from.
+type initAnswers struct {
+	Board         initBoard
+	SSHKeys       []string
+	Username      string
+	Networks      []initNetwork
+	Compose       string
+	Autodiscovery bool
+}
+
+type initNetwork struct {
+	SSID       string
+	Passphrase string
+}
+
+// sshPublicKey is a key found in ~/.ssh.
+type sshPublicKey struct {
+	File string
+	Key  string
+}
+
+func runInit(cmd *cobra.Command, args []string) error {
+	nonInteractive, _ := cmd.Flags().GetBool("non-interactive")
+	force, _ := cmd.Flags().GetBool("force")
+
+	sproutFile := configFlag
+	if sproutFile == "" {
+		sproutFile = "sprout.yaml"
+	}
+	sproutFile, err := filepath.Abs(sproutFile)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", sproutFile, err)
+	}
+	if filepath.Ext(sproutFile) == ".json" {
+		return fmt.Errorf("init writes YAML; choose a .yaml or .yml file")
+	}
+	if _, err := os.Stat(sproutFile); err == nil && !force {
+		return fmt.Errorf("%s already exists; use --force to overwrite it", filepath.Base(sproutFile))
+	}
+	dir := filepath.Dir(sproutFile)
+	name := filepath.Base(sproutFile)
+
+	fmt.Printf("\n%s%s🌱 Sprout Init%s\n", Bold, Green, Reset)
+	fmt.Printf("%s%s═══════════════════════════════%s\n\n", Bold, Green, Reset)
+
+	var answers *initAnswers
+	if nonInteractive {
+		answers, err = initAnswersFromFlags(cmd, dir)
+	} else {
+		answers, err = askInitAnswers(bufio.NewReader(os.Stdin), dir)
+	}
+	if err != nil {
+		return printError("%w", err)
+	}
+
+	printStep(fmt.Sprintf("Writing %s...", name))
+	if err := os.WriteFile(sproutFile, []byte(renderSproutYAML(answers)), 0644); err != nil {
+		return printError("failed to write %s: %w", name, err)
+	}
+	printSuccess(fmt.Sprintf("%s written", sproutFile))
+
+	added, err := ensureGitignore(filepath.Join(dir, ".gitignore"), "build/")
+	if err != nil {
+		return printError("failed to update .gitignore: %w", err)
+	}
+	if added {
+		printSuccess("build/ added to .gitignore")
+	}
+
+	printStep(fmt.Sprintf("Validating %s...", name))
+	if err := validateConfig(&nix.Nix{}, sproutFile); err != nil {
+		return err
+	}
+	printSuccess(fmt.Sprintf("%s is valid", name))
+
+	fmt.Printf("\n%sNext, build the image with 'sprout seed'.%s\n", Bold, Reset)
+	return nil
+}
+
+func initAnswersFromFlags(cmd *cobra.Command, dir string) (*initAnswers, error) {
+	boardName, _ := cmd.Flags().GetString("board")
+	username, _ := cmd.Flags().GetString("username")
+	keys, _ := cmd.Flags().GetStringArray("ssh-key")
+	wifi, _ := cmd.Flags().GetStringArray("wifi")
+	compose, _ := cmd.Flags().GetString("compose")
+	noCompose, _ := cmd.Flags().GetBool("no-compose")
+	autodiscovery, _ := cmd.Flags().GetBool("autodiscovery")
+
+	answers := &initAnswers{Username: username, Autodiscovery: autodiscovery}
+
+	i := slices.IndexFunc(initBoards, func(b initBoard) bool { return b.Name == boardName })
+	if i < 0 {
+		return nil, fmt.Errorf("unknown board %q: expected one of %s", boardName, boardNames())
+	}
+	answers.Board = initBoards[i]
+
+	if !usernamePattern.MatchString(username) {
+		return nil, fmt.Errorf("invalid username %q: use lowercase letters, digits, '-' and '_'", username)
+	}
+
+	if len(keys) == 0 {
+		found, err := findSSHPublicKeys()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range found {
+			answers.SSHKeys = append(answers.SSHKeys, key.Key)
+		}
+	}
+	for _, key := range keys {
+		if data, err := os.ReadFile(key); err == nil {
+			key = firstLine(string(data))
+		}
+		answers.SSHKeys = append(answers.SSHKeys, key)
+	}
+
+	for _, network := range wifi {
+		ssid, passphrase, ok := strings.Cut(network, "=")
+		if !ok || ssid == "" {
+			return nil, fmt.Errorf("invalid --wifi %q: expected SSID=passphrase", network)
+		}
+		answers.Networks = append(answers.Networks, initNetwork{SSID: ssid, Passphrase: passphrase})
+	}
+	if len(answers.Networks) > 0 && !answers.Board.Wireless {
+		return nil, fmt.Errorf("board %q has no wireless", answers.Board.Name)
+	}
+
+	if !noCompose {
+		answers.Compose = compose
+		if compose == "" {
+			answers.Compose = findComposeFile(dir)
+		}
+	}
+	return answers, nil
+}
+
+func askInitAnswers(reader *bufio.Reader, dir string) (*initAnswers, error) {
+	answers := &initAnswers{}
+
+	// Board
+	printStep("Board")
+	for i, board := range initBoards {
+		printSubStep(fmt.Sprintf("%d. %s", i+1, board.Description))
+	}
+	for {
+		input, err := ask(reader, fmt.Sprintf("Which board is the image for? (1-%d)", len(initBoards)), "1")
+		if err != nil {
+			return nil, err
+		}
+		choice, err := strconv.Atoi(input)
+		if err == nil && choice >= 1 && choice <= len(initBoards) {
+			answers.Board = initBoards[choice-1]
+			break
+		}
+		fmt.Printf("%sEnter a number between 1 and %d.%s\n", Red, len(initBoards), Reset)
+	}
+
+	// Compose
+	if compose := findComposeFile(dir); compose != "" {
+		printStep("Docker Compose")
+		embed, err := confirm(reader, fmt.Sprintf("Found %s. Embed it in the image?", compose), true)
+		if err != nil {
+			return nil, err
+		}
+		if embed {
+			answers.Compose = compose
+		}
+	}
+
+	// SSH keys
+	printStep("SSH keys")
+	keys, err := findSSHPublicKeys()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		for i, key := range keys {
+			printSubStep(fmt.Sprintf("%d. %s (%s)", i+1, describeKey(key.Key), key.File))
+		}
+		for {
+			input, err := ask(reader, "Keys allowed to log in (e.g. 1,3, or 'none')", "all")
+			if err != nil {
+				return nil, err
+			}
+			selected, err := selectKeys(keys, input)
+			if err == nil {
+				answers.SSHKeys = selected
+				break
+			}
+			fmt.Printf("%s%v%s\n", Red, err, Reset)
+		}
+	} else {
+		printSubStep("No public keys found in ~/.ssh")
+		key, err := ask(reader, "Paste a public key (or press Enter to skip)", "")
+		if err != nil {
+			return nil, err
+		}
+		if key != "" {
+			answers.SSHKeys = []string{key}
+		}
+	}
+	if len(answers.SSHKeys) == 0 {
+		fmt.Printf("%sWithout SSH keys the device can only be reached with a keyboard and screen.%s\n", Yellow, Reset)
+	}
+
+	// Wireless
+	if answers.Board.Wireless {
+		printStep("Wireless")
+		for {
+			add, err := confirm(reader, "Add a wireless network?", len(answers.Networks) == 0)
+			if err != nil {
+				return nil, err
+			}
+			if !add {
+				break
+			}
+			ssid, err := ask(reader, "SSID", "")
+			if err != nil {
+				return nil, err
+			}
+			if ssid == "" {
+				continue
+			}
+			passphrase, err := ask(reader, "Passphrase (shown as typed)", "")
+			if err != nil {
+				return nil, err
+			}
+			answers.Networks = append(answers.Networks, initNetwork{SSID: ssid, Passphrase: passphrase})
+		}
+	}
+
+	// Username
+	printStep("User")
+	for {
+		username, err := ask(reader, "Username", "sprout")
+		if err != nil {
+			return nil, err
+		}
+		if usernamePattern.MatchString(username) {
+			answers.Username = username
+			break
+		}
+		fmt.Printf("%sUse lowercase letters, digits, '-' and '_', starting with a letter.%s\n", Red, Reset)
+	}
+
+	autodiscovery, err := confirm(reader, "Advertise the device over mDNS for 'sprout discover'?", true)
+	if err != nil {
+		return nil, err
+	}
+	answers.Autodiscovery = autodiscovery
+	return answers, nil
+}
+
+// ask prompts for a line of input, returning def if it is empty.
+func ask(reader *bufio.Reader, question, def string) (string, error) {
+	if def != "" {
+		fmt.Printf("%s%s [%s]: %s", Bold, question, def, Reset)
+	} else {
+		fmt.Printf("%s%s: %s", Bold, question, Reset)
+	}
+	input, err := reader.ReadString('\n')
+	if err != nil && (!errors.Is(err, io.EOF) || input == "") {
+		return "", fmt.Errorf("failed to read input: %w", err)
+	}
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return def, nil
+	}
+	return input, nil
+}
+
+// confirm asks a yes/no question.
+func confirm(reader *bufio.Reader, question string, def bool) (bool, error) {
+	options := "y/N"
+	if def {
+		options = "Y/n"
+	}
+	fmt.Printf("%s%s (%s): %s", Bold, question, options, Reset)
+	input, err := reader.ReadString('\n')
+	if err != nil && (!errors.Is(err, io.EOF) || input == "") {
+		return false, fmt.Errorf("failed to read input: %w", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(input)) {
+	case "":
+		return def, nil
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// findComposeFile returns the compose file in dir, if there is one.
+func findComposeFile(dir string) string {
+	for _, name := range composeFileNames {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// findSSHPublicKeys returns the public keys in ~/.ssh.
+func findSSHPublicKeys() ([]sshPublicKey, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get home directory: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(homeDir, ".ssh", "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []sshPublicKey
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if key := firstLine(string(data)); key != "" {
+			keys = append(keys, sshPublicKey{File: "~/.ssh/" + filepath.Base(file), Key: key})
+		}
+	}
+	return keys, nil
+}
+
+// selectKeys picks keys by a comma separated list of their numbers, or
+// "all" or "none".
+func selectKeys(keys []sshPublicKey, input string) ([]string, error) {
+	var selected []string
+	switch input {
+	case "all":
+		for _, key := range keys {
+			selected = append(selected, key.Key)
+		}
+		return selected, nil
+	case "none":
+		return nil, nil
+	}
+
+	for _, field := range strings.Split(input, ",") {
+		choice, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || choice < 1 || choice > len(keys) {
+			return nil, fmt.Errorf("invalid selection %q: enter numbers between 1 and %d", field, len(keys))
+		}
+		if key := keys[choice-1].Key; !slices.Contains(selected, key) {
+			selected = append(selected, key)
+		}
+	}
+	return selected, nil
+}
+
+// describeKey shortens a public key to its type and comment.
+func describeKey(key string) string {
+	fields := strings.Fields(key)
+	if len(fields) > 2 {
+		return fields[0] + " " + strings.Join(fields[2:], " ")
+	}
+	return fields[0]
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return strings.TrimSpace(line)
+}
+
+// yamlString quotes s for YAML. JSON strings are valid YAML double-quoted
+// scalars.
+func yamlString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// renderSproutYAML writes the answers as a commented sprout.yaml.
+func renderSproutYAML(a *initAnswers) string {
+	var b strings.Builder
+	b.WriteString("# yaml-language-server: $schema=https://raw.githubusercontent.com/fcjr/sprout/main/sprout.schema.json\n")
+	b.WriteString("#\n")
+	fmt.Fprintf(&b, "# Sprout configuration for a %s.\n", a.Board.Description)
+	b.WriteString("# Build the image with 'sprout seed' and flash it with 'sprout burn'.\n")
+	b.WriteString("# All settings: https://github.com/fcjr/sprout#configuration-reference\n")
+
+	b.WriteString("\n# Public keys allowed to log in over SSH\n")
+	if len(a.SSHKeys) > 0 {
+		b.WriteString("ssh_keys:\n")
+		for _, key := range a.SSHKeys {
+			fmt.Fprintf(&b, "  - %s\n", yamlString(key))
+		}
+	} else {
+		b.WriteString("# ssh_keys:\n#   - \"ssh-ed25519 AAAA... user@host\"\n")
+	}
+
+	b.WriteString("\n# Account the SSH keys log in as\n")
+	fmt.Fprintf(&b, "username: %s\n", a.Username)
+
+	b.WriteString("\n# Name the device has on the network, and its clock and language\n")
+	b.WriteString("# hostname: sprout\n# timezone: UTC\n# locale: en_US.UTF-8\n")
+
+	if a.Board.Wireless {
+		b.WriteString("\n# Wireless networks the device joins\n")
+		if len(a.Networks) > 0 {
+			b.WriteString("wireless:\n  enabled: true\n  networks:\n")
+			for _, network := range a.Networks {
+				fmt.Fprintf(&b, "    %s:\n      psk: %s\n", yamlString(network.SSID), yamlString(network.Passphrase))
+			}
+		} else {
+			b.WriteString("# wireless:\n#   enabled: true\n#   networks:\n#     \"MyWiFi\":\n#       psk: \"password\"\n")
+		}
+	}
+
+	b.WriteString("\n# Docker Compose project started on boot\n")
+	if a.Compose != "" {
+		fmt.Fprintf(&b, "docker_compose:\n  enabled: true\n  path: %s\n", yamlString(a.Compose))
+	} else {
+		b.WriteString("# docker_compose:\n#   enabled: true\n#   path: docker-compose.yml\n")
+	}
+
+	b.WriteString("\n# Advertise the device over mDNS so 'sprout discover' finds it\n")
+	fmt.Fprintf(&b, "autodiscovery: %t\n", a.Autodiscovery)
+
+	b.WriteString("\n# Where 'sprout seed' writes the image\n")
+	b.WriteString("output:\n  path: build/image.img\n")
+	return b.String()
+}
+
+// ensureGitignore adds entry to the .gitignore at path unless it is
+// already listed, and reports whether it was added.
+func ensureGitignore(path, entry string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == entry || line == "/"+entry || line == strings.TrimSuffix(entry, "/") {
+			return false, nil
+		}
+	}
+
+	content := string(data)
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	content += "# Images built by sprout seed\n" + entry + "\n"
+	return true, os.WriteFile(path, []byte(content), 0644)
+}
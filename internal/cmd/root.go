@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"context"
+	"os"
 	"time"
 
 	"github.com/fcjr/sprout/internal/version"
@@ -22,7 +23,12 @@ const commandTimeout = 15 * time.Second
 func Execute() {
 	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
 	defer cancel()
-	cobra.CheckErr(rootCmd.ExecuteContext(ctx))
+	// Cobra prints the error itself, unless the command printed it already
+	// and silenced cobra
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
+		cancel()
+		os.Exit(1)
+	}
 }
 
 func init() {
@@ -30,4 +36,7 @@ func init() {
 
 	// Root Flags
 	rootCmd.Flags().BoolP("version", "v", false, "Get the version of sprout") // overrides default msg
+	rootCmd.PersistentFlags().StringVarP(&configFlag, "config", "c", "", "Config file (default: sprout.yaml, sprout.yml or sprout.json in the current directory, or $SPROUT_CONFIG)")
+	rootCmd.PersistentFlags().StringVar(&deviceFlag, "device", "", "Device of the config file's devices section to use")
+	rootCmd.PersistentFlags().StringArrayVar(&overlayFlags, "overlay", nil, "File merged over the config file (repeatable)")
 }
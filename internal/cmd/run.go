@@ -0,0 +1,245 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fcjr/sprout/internal/deploy"
+	"github.com/fcjr/sprout/internal/nix"
+	"github.com/spf13/cobra"
+)
+
+var runCmd = &cobra.Command{
+	Use:   "run [image-file]",
+	Short: "Boot a Sprout image in QEMU",
+	Long: `Run boots a Sprout image in a QEMU virtual machine, so sprout.yaml can be
+tried without a device. The serial console is streamed to the terminal; press
+Ctrl-A X to quit.
+
+The image itself is not modified: the machine writes to a temporary overlay.
+SSH and the agent port are forwarded to localhost:
+
+  ssh -p 2222 sprout@localhost
+
+With --check, sprout waits for the system to finish booting over SSH, shuts
+the machine down and exits non-zero unless SSH, the Sprout daemon and every
+compose stack came up, which makes it usable as a boot test.
+
+If no image file is specified, the image built by 'sprout seed' is used.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runRun,
+}
+
+func init() {
+	rootCmd.AddCommand(runCmd)
+	runCmd.Flags().Int("memory", 2048, "Memory of the machine in MiB")
+	runCmd.Flags().Int("cpus", 2, "Number of CPUs of the machine")
+	runCmd.Flags().Int("disk-size", 8, "Size of the machine's disk in GiB, for the partitions added on first boot")
+	runCmd.Flags().Int("ssh-port", 2222, "Local port forwarded to SSH on the machine")
+	runCmd.Flags().Int("agent-port", 8080, "Local port forwarded to the Sprout agent on the machine (0 to disable)")
+	runCmd.Flags().String("firmware", "", "U-Boot binary of the machine (built with Nix if not given)")
+	runCmd.Flags().Bool("check", false, "Wait for the system to boot over SSH, then shut down and report its state")
+	runCmd.Flags().Duration("timeout", 10*time.Minute, "How long --check waits for the system to boot")
+}
+
+func runRun(cmd *cobra.Command, args []string) error {
+	memory, _ := cmd.Flags().GetInt("memory")
+	cpus, _ := cmd.Flags().GetInt("cpus")
+	diskSize, _ := cmd.Flags().GetInt("disk-size")
+	sshPort, _ := cmd.Flags().GetInt("ssh-port")
+	agentPort, _ := cmd.Flags().GetInt("agent-port")
+	firmware, _ := cmd.Flags().GetString("firmware")
+	check, _ := cmd.Flags().GetBool("check")
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+
+	fmt.Printf("\n%s%s🌱 Sprout Run%s\n", Bold, Green, Reset)
+	fmt.Printf("%s%s═══════════════════════════════%s\n\n", Bold, Green, Reset)
+
+	// Images are always built for aarch64 boards
+	qemuPath, err := exec.LookPath("qemu-system-aarch64")
+	if err != nil {
+		return printError("qemu-system-aarch64 not found; install QEMU to run images")
+	}
+	qemuImgPath, err := exec.LookPath("qemu-img")
+	if err != nil {
+		return printError("qemu-img not found; install QEMU to run images")
+	}
+
+	imagePath, err := findImageFile(args)
+	if err != nil {
+		return printError("%w", err)
+	}
+	if _, err := os.Stat(imagePath); err != nil {
+		return printError("image file not found: %s", imagePath)
+	}
+
+	if firmware == "" {
+		printStep("Preparing U-Boot for QEMU...")
+		nixInstance := &nix.Nix{}
+		firmware, err = nixInstance.BuildQEMUFirmware()
+		if err != nil {
+			return printError("failed to build U-Boot: %w", err)
+		}
+		printSuccess("U-Boot ready")
+	}
+
+	printStep("Creating disk overlay...")
+	tempDir, err := os.MkdirTemp("", "sprout-run-*")
+	if err != nil {
+		return printError("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	diskBytes := int64(diskSize) << 30
+	requiredSize, err := requiredCardSize(imagePath)
+	if err != nil {
+		return printError("%w", err)
+	}
+	// Round up to whole MiB, as QEMU requires for the disk size
+	diskBytes = (max(diskBytes, requiredSize) + 1<<20 - 1) &^ (1<<20 - 1)
+
+	overlay := filepath.Join(tempDir, "disk.qcow2")
+	output, err := exec.Command(qemuImgPath, "create", "-q", "-f", "qcow2", "-F", "raw", "-b", imagePath, overlay, strconv.FormatInt(diskBytes, 10)).CombinedOutput()
+	if err != nil {
+		return printError("failed to create disk overlay: %w\nOutput: %s", err, output)
+	}
+	printSuccess(fmt.Sprintf("Disk of %s backed by %s", formatBytes(diskBytes), filepath.Base(imagePath)))
+
+	forwards := fmt.Sprintf("hostfwd=tcp:127.0.0.1:%d-:22", sshPort)
+	if agentPort != 0 {
+		forwards += fmt.Sprintf(",hostfwd=tcp:127.0.0.1:%d-:8080", agentPort)
+	}
+	qemuArgs := []string{
+		"-m", strconv.Itoa(memory),
+		"-smp", strconv.Itoa(cpus),
+		"-nographic",
+		"-drive", "if=none,id=disk,format=qcow2,file=" + overlay,
+		"-device", "virtio-blk-pci,drive=disk",
+		"-netdev", "user,id=net," + forwards,
+		"-device", "virtio-net-pci,netdev=net",
+		// A kernel panic ends the run with a failure
+		"-action", "panic=exit-failure",
+	}
+	qemuArgs = append(qemuArgs, machineArgs(firmware)...)
+
+	printStep("Booting...")
+	printSubStep(fmt.Sprintf("SSH: ssh -p %d <user>@localhost", sshPort))
+	if agentPort != 0 {
+		printSubStep(fmt.Sprintf("Agent: localhost:%d", agentPort))
+	}
+	fmt.Println()
+
+	qemu := exec.Command(qemuPath, qemuArgs...)
+	qemu.Stdin = os.Stdin
+	qemu.Stdout = os.Stdout
+	qemu.Stderr = os.Stderr
+	if err := qemu.Start(); err != nil {
+		return printError("failed to start QEMU: %w", err)
+	}
+
+	if !check {
+		if err := qemu.Wait(); err != nil {
+			return printError("the machine exited with an error: %w", err)
+		}
+		return nil
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- qemu.Wait() }()
+
+	status, err := waitForBoot(sshPort, runUser(), timeout, exited)
+	if err != nil {
+		qemu.Process.Kill()
+		return printError("%w", err)
+	}
+
+	qemu.Process.Signal(os.Interrupt)
+	select {
+	case <-exited:
+	case <-time.After(10 * time.Second):
+		qemu.Process.Kill()
+		<-exited
+	}
+
+	if status != "running" {
+		return printError("the system booted, but is %s", status)
+	}
+	printSuccess("The system booted and its units are running")
+	return nil
+}
+
+// machineArgs returns the QEMU machine settings, using hardware
+// acceleration when the host can run the guest natively.
+func machineArgs(firmware string) []string {
+	var accel []string
+	native := runtime.GOARCH == "arm64"
+	switch {
+	case native && runtime.GOOS == "darwin":
+		accel = []string{"-accel", "hvf", "-cpu", "host"}
+	case native && runtime.GOOS == "linux" && canUseKVM():
+		accel = []string{"-accel", "kvm", "-cpu", "host"}
+	default:
+		accel = []string{"-accel", "tcg", "-cpu", "max"}
+	}
+	return append([]string{"-M", "virt", "-bios", firmware, "-device", "pvpanic-pci"}, accel...)
+}
+
+func canUseKVM() bool {
+	kvm, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	kvm.Close()
+	return true
+}
+
+// runUser returns the user to log in as, from sprout.yaml if there is one.
+func runUser() string {
+	sproutFile, err := findConfigFile()
+	if err != nil || sproutFile == "" {
+		return "sprout"
+	}
+	nixInstance := newNix(false)
+	config, err := nixInstance.LoadConfigOnly(sproutFile)
+	if err != nil {
+		return "sprout"
+	}
+	return config.Username
+}
+
+// waitForBoot waits until the machine's system has finished booting and
+// returns the state of the units Sprout runs, e.g. running or not running
+// with the units that failed.
+func waitForBoot(sshPort int, user string, timeout time.Duration, exited <-chan error) (string, error) {
+	remote := deploy.NewRemote(user+"@127.0.0.1", sshPort)
+	// Every run has new host keys
+	remote.Options = []string{"StrictHostKeyChecking=no", "UserKnownHostsFile=/dev/null", "LogLevel=ERROR"}
+	defer remote.Close()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = errors.New("it shut down")
+			}
+			return "", fmt.Errorf("the machine stopped before it finished booting: %w", err)
+		case <-time.After(5 * time.Second):
+		}
+
+		output, err := remote.Output("/run/current-system/sw/bin/sprout-system health")
+		status := strings.TrimSpace(output)
+		if err != nil && (deploy.ConnectionLost(err) || status == "") {
+			continue
+		}
+		return status, nil
+	}
+	return "", fmt.Errorf("the system did not finish booting within %v", timeout)
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/fcjr/sprout/internal/nix"
+	"github.com/spf13/cobra"
+)
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the JSON schema of sprout.yaml",
+	Long: `Schema prints the JSON schema of sprout.yaml, derived from the
+configuration types Sprout reads it into. Editors use it for completion and
+checking; sprout.schema.json in the repository is generated with
+
+  sprout schema -o sprout.schema.json`,
+	Args: cobra.NoArgs,
+	RunE: runSchema,
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+	schemaCmd.Flags().StringP("output", "o", "", "Write the schema to a file instead of standard output")
+}
+
+func runSchema(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+
+	data, err := nix.Schema()
+	if err != nil {
+		return fmt.Errorf("failed to generate schema: %w", err)
+	}
+	if output == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(output, data, 0644); err != nil {
+		return fmt.Errorf("failed to write schema: %w", err)
+	}
+	return nil
+}
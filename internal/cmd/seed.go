@@ -13,6 +13,8 @@ import (
 
 func init() {
 	rootCmd.AddCommand(seedCmd)
+	seedCmd.Flags().Bool("hermetic", false, "Refuse build host environment variables when resolving the compose project")
+	seedCmd.Flags().Bool("all-devices", false, "Build an image for every device in the devices section")
 }
 
 var seedCmd = &cobra.Command{
@@ -23,36 +25,89 @@ var seedCmd = &cobra.Command{
 }
 
 func runSeed(cmd *cobra.Command, args []string) error {
+	// Errors are printed as they happen, and are not about usage once the
+	// arguments are accepted
+	cmd.SilenceUsage, cmd.SilenceErrors = true, true
+	hermetic, _ := cmd.Flags().GetBool("hermetic")
+	allDevices, _ := cmd.Flags().GetBool("all-devices")
+	if allDevices && deviceFlag != "" {
+		return printError("--device and --all-devices cannot be used together")
+	}
+
 	startTime := time.Now()
 	printHeader()
 
-	// Get current working directory
-	printStep("Finding current directory...")
-	cwd, err := os.Getwd()
+	printStep("🌱 Looking for sprout.yaml...")
+	sproutFile, err := configFile()
 	if err != nil {
-		return printError("failed to get current working directory: %w", err)
+		return printError("%w", err)
 	}
-	printSuccess(fmt.Sprintf("Working in %s", cwd))
+	printSuccess(fmt.Sprintf("Found %s", sproutFile))
 
-	// Read sprout.yaml from current directory
-	printStep("🌱 Looking for sprout.yaml...")
-	sproutFile := filepath.Join(cwd, "sprout.yaml")
-	if _, err := os.Stat(sproutFile); os.IsNotExist(err) {
-		return printError("sprout.yaml not found in current directory")
+	nixInstance := newNix(hermetic)
+	defer nixInstance.Close()
+	if !allDevices {
+		return seed(nixInstance, sproutFile, startTime)
+	}
+	return seedDevices(nixInstance, sproutFile, startTime)
+}
+
+// seedDevices builds an image for every device of sproutFile. The devices
+// share nixInstance, so images pulled for one are not pulled again.
+func seedDevices(nixInstance *nix.Nix, sproutFile string, startTime time.Time) error {
+	config, err := nixInstance.LoadConfigOnly(sproutFile)
+	if err != nil {
+		return printError("failed to load configuration from %s: %w", filepath.Base(sproutFile), err)
+	}
+	devices := config.Devices.Names()
+	if len(devices) == 0 {
+		return printError("%s has no devices", filepath.Base(sproutFile))
 	}
-	printSuccess("Found sprout.yaml")
+
+	var outputs []string
+	for i, device := range devices {
+		fmt.Printf("\n%s%sDevice %s (%d/%d)%s\n", Bold, Green, device, i+1, len(devices), Reset)
+		nixInstance.Device = device
+		if err := seed(nixInstance, sproutFile, time.Now()); err != nil {
+			return printError("failed to build device %s: %w", device, err)
+		}
+		config, err := nixInstance.LoadConfigOnly(sproutFile)
+		if err != nil {
+			return printError("failed to load configuration of device %s: %w", device, err)
+		}
+		outputs = append(outputs, config.Output.Path)
+	}
+
+	fmt.Printf("\n%s%sBuilt %d devices in %s%s\n", Bold, Green, len(devices), formatDuration(time.Since(startTime)), Reset)
+	for i, device := range devices {
+		fmt.Printf("  %s%s: %s%s\n", Cyan, device, outputs[i], Reset)
+	}
+	return nil
+}
+
+// seed builds the image described by sproutFile and copies it to the
+// configured output path.
+func seed(nixInstance *nix.Nix, sproutFile string, startTime time.Time) error {
+
+	printStep("Validating configuration...")
+	if err := validateConfig(nixInstance, sproutFile); err != nil {
+		return err
+	}
+	printSuccess("Configuration is valid")
 
 	// Load configuration from YAML
 	printStep("Loading configuration...")
-	nixInstance := &nix.Nix{}
 	config, err := nixInstance.LoadConfig(sproutFile)
 	if err != nil {
-		return printError("failed to load configuration from sprout.yaml: %w", err)
+		return printError("failed to load configuration from %s: %w", filepath.Base(sproutFile), err)
 	}
 	printConfigInfo(config)
+	if config.Secrets.Path != "" {
+		defer os.RemoveAll(config.Secrets.Path)
+	}
 
-	// Build Sprout binary if autodiscovery is enabled
-	if config.Autodiscovery {
+	// Build Sprout binary if the image runs it
+	if config.NeedsSproutBinary() {
 		printStep("Building Sprout binary for ARM64...")
 		binaryPath, err := nixInstance.BuildSproutBinary()
 		if err != nil {
@@ -100,17 +155,7 @@ func runSeed(cmd *cobra.Command, args []string) error {
 	printSuccess(fmt.Sprintf("Image built in %v", formatDuration(buildDuration)))
 	printSubStep(fmt.Sprintf("Image location: %s", imagePath))
 
-	// Set default output path if not specified
 	outputPath := config.Output.Path
-	if outputPath == "" {
-		outputPath = "build/image.img"
-	}
-
-	// If relative path, make it relative to current working directory
-	if !filepath.IsAbs(outputPath) {
-		outputPath = filepath.Join(cwd, outputPath)
-	}
-
 	printStep("Preparing output location...")
 	printSubStep(fmt.Sprintf("Destination: %s", outputPath))
 
@@ -137,6 +182,14 @@ func runSeed(cmd *cobra.Command, args []string) error {
 	}
 	copyDuration := time.Since(copyStart)
 
+	if config.Secrets.Path != "" {
+		printStep("Installing secrets...")
+		if err := nixInstance.InstallSecrets(outputPath, config); err != nil {
+			return printError("failed to install secrets: %w", err)
+		}
+		printSuccess(fmt.Sprintf("%d secret(s) written to the root filesystem", len(config.Secrets.Values)))
+	}
+
 	totalDuration := time.Since(startTime)
 	printFinalSuccess(outputPath, totalDuration, copyDuration)
 	return nil
@@ -183,12 +236,26 @@ func printConfigInfo(config *nix.SproutFile) {
 	if config.Wireless.Enabled {
 		fmt.Printf("    %s• Wireless: %d network(s)%s\n", Cyan, len(config.Wireless.Networks), Reset)
 	}
-	if config.DockerCompose.Enabled {
-		fmt.Printf("    %s• Docker Compose: enabled%s\n", Cyan, Reset)
+	if stacks := config.DockerCompose.Enabled(); len(stacks) > 0 {
+		fmt.Printf("    %s• Docker Compose: %d stack(s)%s\n", Cyan, len(stacks), Reset)
 	}
 	if config.Autodiscovery {
 		fmt.Printf("    %s• Autodiscovery: enabled%s\n", Cyan, Reset)
 	}
+	if config.Image.ABLayout() {
+		fmt.Printf("    %s• Layout: A/B slots of %d MiB%s\n", Cyan, config.Image.RootSize, Reset)
+	} else if config.Image.RootSize > 0 {
+		fmt.Printf("    %s• Root: %d MiB%s\n", Cyan, config.Image.RootSize, Reset)
+	}
+	if config.Image.RootFS != nix.RootFSExt4 {
+		fmt.Printf("    %s• Root filesystem: %s%s\n", Cyan, config.Image.RootFS, Reset)
+	}
+	if config.Image.DockerPartition {
+		fmt.Printf("    %s• Docker partition: enabled%s\n", Cyan, Reset)
+	}
+	if len(config.Secrets.Values) > 0 {
+		fmt.Printf("    %s• Secrets: %d%s\n", Cyan, len(config.Secrets.Values), Reset)
+	}
 }
 
 func formatDuration(d time.Duration) string {
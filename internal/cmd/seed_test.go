@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+
+	"github.com/fcjr/sprout/internal/nix/nixtest"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestSeedGolden(t *testing.T) {
+	tests := []struct {
+		fixture string
+		device  string
+		output  string
+		builds  []string
+		pulls   []string
+	}{
+		{fixture: "wireless"},
+		{fixture: "wireless-list"},
+		{fixture: "compose-build", builds: []string{"web"}},
+		{fixture: "compose-pull", pulls: []string{"nginx:alpine", "redis:7-alpine"}},
+		{fixture: "autodiscovery"},
+		{fixture: "network"},
+		{fixture: "device", device: "kiosk-1", output: "image-kiosk-1.img"},
+		{fixture: "ab"},
+		{fixture: "data-root", pulls: []string{"nginx:alpine", "redis:7-alpine"}},
+		{fixture: "docker-partition", pulls: []string{"nginx:alpine", "redis:7-alpine"}},
+		{fixture: "btrfs", pulls: []string{"nginx:alpine", "redis:7-alpine"}},
+		{fixture: "readonly", pulls: []string{"nginx:alpine", "redis:7-alpine"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			fixture := filepath.Join("testdata", "seed", tt.fixture)
+			dir := t.TempDir()
+			if err := os.CopyFS(dir, os.DirFS(fixture)); err != nil {
+				t.Fatal(err)
+			}
+			os.Remove(filepath.Join(dir, "image.nix.golden"))
+
+			nixInstance, engine, builder, fetcher := nixtest.New(dir)
+			nixInstance.Device = tt.device
+			// The data root builder leaves the filesystem in its work directory
+			engine.RunFunc = func(config *container.Config, hostConfig *container.HostConfig) (string, error) {
+				for _, m := range hostConfig.Mounts {
+					if m.Target == "/work" {
+						return "", os.WriteFile(filepath.Join(m.Source, "docker-data.img"), []byte("data root"), 0644)
+					}
+				}
+				return "", nil
+			}
+			if err := seed(nixInstance, filepath.Join(dir, "sprout.yaml"), time.Now()); err != nil {
+				t.Fatalf("seed: %v", err)
+			}
+
+			if !slices.Equal(fetcher.Builds, tt.builds) {
+				t.Errorf("built %v, want %v", fetcher.Builds, tt.builds)
+			}
+			if !slices.Equal(fetcher.Pulls, tt.pulls) {
+				t.Errorf("pulled %v, want %v", fetcher.Pulls, tt.pulls)
+			}
+			output := cmp.Or(tt.output, "image.img")
+			if _, err := os.Stat(filepath.Join(dir, "build", output)); err != nil {
+				t.Errorf("image was not copied to the output path: %v", err)
+			}
+
+			got := strings.ReplaceAll(builder.Nix, dir, "$FIXTURE")
+			for _, problem := range duplicateAttributes(got) {
+				t.Errorf("generated Nix does not evaluate: %s", problem)
+			}
+			golden := filepath.Join(fixture, "image.nix.golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if got != string(want) {
+				t.Errorf("generated Nix differs from %s (run with -update to accept it):\n%s", golden, got)
+			}
+		})
+	}
+}
+
+// bindingPattern matches an attribute binding such as
+// `systemd.services."name".enable = true;`.
+var bindingPattern = regexp.MustCompile(`^((?:[A-Za-z_][\w'-]*|"[^"]*")(?:\.(?:[A-Za-z_][\w'-]*|"[^"]*"))*) = (.*)$`)
+
+// duplicateAttributes finds attribute paths that are set twice in one
+// attribute set of the generated Nix, which Nix rejects with "attribute
+// already defined". Attribute sets are told apart by indentation, and the
+// contents of multi-line strings are skipped. As in Nix, two definitions are only
+// merged when both are attribute set literals.
+func duplicateAttributes(nix string) []string {
+	type binding struct {
+		line    int
+		literal bool
+	}
+	type frame struct {
+		indent   int
+		bindings map[string]binding
+	}
+	var problems []string
+	var frames []*frame
+	inString := false
+	for i, line := range strings.Split(nix, "\n") {
+		wasInString := inString
+		for j := 0; j+1 < len(line); j++ {
+			if line[j] != '\'' || line[j+1] != '\'' {
+				continue
+			}
+			if inString && j+2 < len(line) && strings.ContainsRune("'$\\", rune(line[j+2])) {
+				// An escape inside the string
+				j += 2
+				continue
+			}
+			inString = !inString
+			j++
+		}
+		trimmed := strings.TrimSpace(line)
+		if wasInString || trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		for len(frames) > 0 && frames[len(frames)-1].indent > indent {
+			frames = frames[:len(frames)-1]
+		}
+		m := bindingPattern.FindStringSubmatch(trimmed)
+		if m == nil {
+			continue
+		}
+		if len(frames) == 0 || frames[len(frames)-1].indent < indent {
+			frames = append(frames, &frame{indent: indent, bindings: make(map[string]binding)})
+		}
+		bindings := frames[len(frames)-1].bindings
+
+		path := strings.ReplaceAll(m[1], `"`, "")
+		current := binding{line: i + 1, literal: strings.HasPrefix(m[2], "{")}
+		for other, previous := range bindings {
+			var conflict bool
+			switch {
+			case other == path:
+				conflict = !previous.literal || !current.literal
+			case strings.HasPrefix(path, other+"."):
+				conflict = !previous.literal
+			case strings.HasPrefix(other, path+"."):
+				conflict = !current.literal
+			}
+			if conflict {
+				problems = append(problems, fmt.Sprintf("line %d sets %s, which line %d already sets as %s", current.line, path, previous.line, other))
+			}
+		}
+		bindings[path] = current
+	}
+	return problems
+}
+
+func TestDuplicateAttributes(t *testing.T) {
+	nix := `{
+  a.b = 1;
+  c = { d = 1; };
+  c.e = 2;
+  f = lib.mkForce { g = 1; };
+  f.h = 2;
+  s = ''
+    a.b = 1;
+    x = ''${y}
+  '';
+  n = {
+    a.b = 2;
+  };
+  a.b = 3;
+}`
+	got := duplicateAttributes(nix)
+	want := []string{
+		"line 6 sets f.h, which line 5 already sets as f",
+		"line 14 sets a.b, which line 2 already sets as a.b",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("duplicateAttributes() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/fcjr/sprout/internal/slot"
+	"github.com/spf13/cobra"
+)
+
+var slotCmd = &cobra.Command{
+	Use:   "slot",
+	Short: "Manage the root slots of a device with an A/B layout",
+	Long: `Slot installs whole Sprout images on a device built with image.layout: ab.
+
+The new root filesystem is written to the inactive slot, which is booted next.
+If its SSH, daemon and compose units do not come up within the configured
+number of boots, the device falls back to the previous slot. Boots are
+counted by the new system, so a slot whose kernel fails to start is not
+rolled back and has to be re-flashed. These commands run on the device.`,
+}
+
+var slotStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the running slot and any pending update",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		device, err := slot.Detect()
+		if err != nil {
+			return err
+		}
+		state, err := slot.LoadState()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Disk: %s\n", device.Disk)
+		fmt.Printf("Running slot: %d\n", device.Current)
+		if state.Trial != 0 {
+			fmt.Printf("On trial: slot %d, %d boot(s) left before falling back to slot %d\n", state.Trial, state.BootsLeft, state.Fallback)
+		}
+		if state.Failed != 0 {
+			fmt.Printf("Last failed update: slot %d\n", state.Failed)
+		}
+		return nil
+	},
+}
+
+var slotInstallCmd = &cobra.Command{
+	Use:   "install <image|->",
+	Short: "Write a Sprout image to the inactive slot and boot it next",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		reboot, _ := cmd.Flags().GetBool("reboot")
+
+		device, err := slot.Detect()
+		if err != nil {
+			return err
+		}
+		config, err := slot.LoadConfig()
+		if err != nil {
+			return err
+		}
+
+		var image io.Reader = os.Stdin
+		if args[0] != "-" {
+			file, err := os.Open(args[0])
+			if err != nil {
+				return fmt.Errorf("failed to open image: %w", err)
+			}
+			defer file.Close()
+			image = file
+		}
+
+		fmt.Printf("Installing to slot %d...\n", device.Other())
+		size, err := device.Install(image, config.BootAttempts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("✓ Wrote %d MiB to slot %d; it is booted next\n", size>>20, device.Other())
+
+		if !reboot {
+			fmt.Printf("Reboot to start it\n")
+			return nil
+		}
+		return exec.Command("systemctl", "reboot").Run()
+	},
+}
+
+var slotBootCmd = &cobra.Command{
+	Use:    "boot",
+	Short:  "Count a boot of a slot on trial (run at boot)",
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		device, err := slot.Detect()
+		if err != nil {
+			return err
+		}
+		_, err = device.Boot()
+		return err
+	},
+}
+
+var slotConfirmCmd = &cobra.Command{
+	Use:    "confirm",
+	Short:  "Keep a slot on trial once its units are running (run at boot)",
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+
+		device, err := slot.Detect()
+		if err != nil {
+			return err
+		}
+		return device.Confirm(timeout)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(slotCmd)
+	slotCmd.AddCommand(slotStatusCmd, slotInstallCmd, slotBootCmd, slotConfirmCmd)
+	slotInstallCmd.Flags().Bool("reboot", false, "Reboot into the new slot right away")
+	slotConfirmCmd.Flags().Duration("timeout", 10*time.Minute, "How long to wait for the system to finish booting")
+}
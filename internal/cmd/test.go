@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var testCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Boot the system described by sprout.yaml in a test VM",
+	Long: `Test boots the NixOS system described by sprout.yaml in a virtual machine
+using the NixOS test framework, and checks that it comes up as configured:
+
+  - sshd is running and listening
+  - wireless networks are configured
+  - the Sprout daemon is advertised over mDNS (autodiscovery)
+  - every embedded Docker image is loaded and every compose stack is up
+
+Further assertions can be added under 'test' in sprout.yaml. The VM uses KVM
+when available and falls back to emulation otherwise, which is slower but
+works anywhere Nix or Docker runs. The partition layout of the image is not
+exercised, as the VM boots from its own disk.`,
+	Args: cobra.NoArgs,
+	RunE: runTest,
+}
+
+func init() {
+	rootCmd.AddCommand(testCmd)
+	testCmd.Flags().Bool("hermetic", false, "Refuse build host environment variables when resolving the compose project")
+}
+
+func runTest(cmd *cobra.Command, args []string) error {
+	hermetic, _ := cmd.Flags().GetBool("hermetic")
+
+	startTime := time.Now()
+	fmt.Printf("\n%s%s🌱 Sprout Test%s\n", Bold, Green, Reset)
+	fmt.Printf("%s%s═══════════════════════════════%s\n\n", Bold, Green, Reset)
+
+	sproutFile, err := configFile()
+	if err != nil {
+		return printError("%w", err)
+	}
+
+	printStep("Loading configuration...")
+	nixInstance := newNix(hermetic)
+	defer nixInstance.Close()
+	config, err := nixInstance.LoadConfig(sproutFile)
+	if config != nil && config.Secrets.Path != "" {
+		defer os.RemoveAll(config.Secrets.Path)
+	}
+	if err != nil {
+		return printError("failed to load configuration from %s: %w", filepath.Base(sproutFile), err)
+	}
+	printConfigInfo(config)
+
+	if config.NeedsSproutBinary() {
+		printStep("Building Sprout binary for ARM64...")
+		binaryPath, err := nixInstance.BuildSproutBinary()
+		if err != nil {
+			return printError("failed to build Sprout binary: %w", err)
+		}
+		config.SproutBinaryPath = binaryPath
+		defer os.RemoveAll(filepath.Dir(binaryPath))
+		printSuccess("Sprout binary built")
+	}
+
+	printStep("Generating Nix configuration...")
+	nixConfig, err := nixInstance.GenerateImage(*config)
+	if err != nil {
+		return printError("failed to generate Nix configuration: %w", err)
+	}
+	tempFile, err := os.CreateTemp("", "image-*.nix")
+	if err != nil {
+		return printError("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+	if _, err := tempFile.WriteString(nixConfig); err != nil {
+		return printError("failed to write to temporary file: %w", err)
+	}
+	printSuccess("Nix configuration generated")
+
+	printStep("Running VM test (this may take several minutes)...")
+	testStart := time.Now()
+	if err := nixInstance.RunTest(tempFile.Name(), config); err != nil {
+		return printError("%w", err)
+	}
+	printSuccess(fmt.Sprintf("Test passed in %v", formatDuration(time.Since(testStart))))
+
+	fmt.Printf("\n%s%sAll checks passed!%s\n", Bold, Green, Reset)
+	fmt.Printf("%sTotal time: %s%s\n", Bold, formatDuration(time.Since(startTime)), Reset)
+	return nil
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fcjr/sprout/internal/deploy"
+	"github.com/fcjr/sprout/internal/nix"
+	"github.com/spf13/cobra"
+)
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade <node>",
+	Short: "Upgrade the NixOS system of a running Sprout node",
+	Long: `Upgrade builds the system described by sprout.yaml, copies the store paths
+the node is missing over SSH and activates the new system.
+
+The new system has to report healthy within the confirmation window. Only then
+does it become the boot default; otherwise the node switches back to the
+previous system on its own, even if the connection is lost. A reboot before
+confirmation also boots the previous system.
+
+The node can be given as host, user@host, or the name of a node found with
+'sprout discover'. The node must run an image built with upgrade support.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runUpgrade,
+}
+
+func init() {
+	rootCmd.AddCommand(upgradeCmd)
+	upgradeCmd.Flags().Int("port", 22, "SSH port of the node")
+	upgradeCmd.Flags().Bool("hermetic", false, "Refuse build host environment variables when resolving the compose project")
+	upgradeCmd.Flags().Duration("timeout", 5*time.Minute, "How long the new system has to become healthy before it is rolled back")
+}
+
+func runUpgrade(cmd *cobra.Command, args []string) error {
+	port, _ := cmd.Flags().GetInt("port")
+	hermetic, _ := cmd.Flags().GetBool("hermetic")
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	if timeout < time.Minute {
+		return printError("--timeout must be at least 1m")
+	}
+
+	startTime := time.Now()
+	fmt.Printf("\n%s%s🌱 Sprout Upgrade%s\n", Bold, Green, Reset)
+	fmt.Printf("%s%s═══════════════════════════════%s\n\n", Bold, Green, Reset)
+
+	sproutFile, err := configFile()
+	if err != nil {
+		return printError("%w", err)
+	}
+
+	printStep("Loading configuration...")
+	nixInstance := newNix(hermetic)
+	defer nixInstance.Close()
+	config, err := nixInstance.LoadSystemConfig(sproutFile)
+	if err != nil {
+		return printError("failed to load configuration from %s: %w", filepath.Base(sproutFile), err)
+	}
+	printConfigInfo(config)
+	if len(config.SSHKeys) == 0 {
+		return printError("upgrade needs ssh_keys in sprout.yaml")
+	}
+	if config.Image.ReadonlyRoot {
+		return printError("upgrade cannot change a read-only root; use image.layout: ab and 'sprout slot install' instead")
+	}
+
+	if config.NeedsSproutBinary() {
+		printStep("Building Sprout binary for ARM64...")
+		binaryPath, err := nixInstance.BuildSproutBinary()
+		if err != nil {
+			return printError("failed to build Sprout binary: %w", err)
+		}
+		config.SproutBinaryPath = binaryPath
+		defer os.RemoveAll(filepath.Dir(binaryPath))
+		printSuccess("Sprout binary built")
+	}
+
+	printStep("Generating Nix configuration...")
+	nixConfig, err := nixInstance.GenerateImage(*config)
+	if err != nil {
+		return printError("failed to generate Nix configuration: %w", err)
+	}
+	tempFile, err := os.CreateTemp("", "image-*.nix")
+	if err != nil {
+		return printError("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+	if _, err := tempFile.WriteString(nixConfig); err != nil {
+		return printError("failed to write to temporary file: %w", err)
+	}
+	printSuccess("Nix configuration generated")
+
+	printStep("Building NixOS system (this may take several minutes)...")
+	buildStart := time.Now()
+	build, err := nixInstance.BuildSystem(tempFile.Name(), config)
+	if err != nil {
+		return printError("failed to build system: %w", err)
+	}
+	defer build.Close()
+	printSuccess(fmt.Sprintf("System built in %v", formatDuration(time.Since(buildStart))))
+	printSubStep(build.Toplevel)
+
+	printStep(fmt.Sprintf("Connecting to %s...", args[0]))
+	target, err := resolveNode(args[0], config.Username)
+	if err != nil {
+		return printError("%w", err)
+	}
+	remote := deploy.NewRemote(target, port)
+	defer remote.Close()
+	if err := remote.Run("true", nil, nil); err != nil {
+		return printError("failed to connect to %s: %w", target, err)
+	}
+	printSuccess(fmt.Sprintf("Connected to %s", target))
+
+	deployer := &deploy.Deployer{Remote: remote}
+
+	printStep("Copying system closure...")
+	missing, err := deployer.MissingPaths(build.Paths)
+	if err != nil {
+		return printError("%w", err)
+	}
+	printSubStep(fmt.Sprintf("%d of %d store paths missing on the node", len(missing), len(build.Paths)))
+	if len(missing) > 0 {
+		if err := copyPaths(nixInstance, deployer, build, missing); err != nil {
+			return printError("%w", err)
+		}
+	}
+	printSuccess("Closure copied")
+
+	printStep("Activating new system...")
+	if err := deployer.SwitchSystem(build.Toplevel, timeout); err != nil {
+		return printError("%w", err)
+	}
+
+	// Leave time to confirm before the node's own rollback timer fires
+	printSubStep(fmt.Sprintf("Waiting up to %v for the node to become healthy...", formatDuration(timeout-30*time.Second)))
+	if !deployer.WaitHealthy(time.Now().Add(timeout - 30*time.Second)) {
+		printSubStep("Rolling back...")
+		if err := deployer.RollbackSystem(); err != nil {
+			printSubStep("The node rolls back on its own once the confirmation window ends")
+		}
+		return printError("the new system did not become healthy and was rolled back")
+	}
+
+	if err := deployer.ConfirmSystem(); err != nil {
+		return printError("%w", err)
+	}
+	printSuccess("New system confirmed")
+
+	fmt.Printf("\n%s%sUpgrade Complete!%s\n", Bold, Green, Reset)
+	fmt.Printf("%sTotal time: %s%s\n", Bold, formatDuration(time.Since(startTime)), Reset)
+	return nil
+}
+
+// copyPaths streams the exported store paths straight into the node's store.
+func copyPaths(nixInstance *nix.Nix, deployer *deploy.Deployer, build *nix.SystemBuild, paths []string) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(nixInstance.ExportPaths(build, paths, writer))
+	}()
+	err := deployer.ImportPaths(reader)
+	reader.Close()
+	return err
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fcjr/sprout/internal/nix/nixtest"
+)
+
+// An upgrade builds the system of the image without the parts only the image
+// holds, but the system has to stay the same.
+func TestUpgradeLoadsSystemOnly(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.CopyFS(dir, os.DirFS(filepath.Join("testdata", "seed", "data-root"))); err != nil {
+		t.Fatal(err)
+	}
+	config, err := os.ReadFile(filepath.Join(dir, "sprout.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = append(config, "\nsecrets:\n  file: secrets.sops.yaml\n  environment: [db_password]\n"...)
+	files := map[string]string{
+		"sprout.yaml":       string(config),
+		"secrets.sops.yaml": "db_password: ENC[AES256_GCM,data:c2VjcmV0,iv:aXY=,tag:dGFn,type:str]\nsops:\n  version: 3.9.0\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nixInstance, engine, _, _ := nixtest.New(dir)
+	sproutFile, err := nixInstance.LoadSystemConfig(filepath.Join(dir, "sprout.yaml"))
+	if err != nil {
+		t.Fatalf("LoadSystemConfig() error = %v", err)
+	}
+	if len(engine.Runs) > 0 || sproutFile.DataRootPath != "" {
+		t.Error("LoadSystemConfig() built a Docker data root")
+	}
+	if sproutFile.Secrets.Path != "" || sproutFile.Secrets.Values["db_password"] != "" {
+		t.Error("LoadSystemConfig() staged the secrets")
+	}
+	if !sproutFile.Secrets.Has("db_password") {
+		t.Error("LoadSystemConfig() did not read the secret names")
+	}
+
+	system, err := nixInstance.GenerateImage(*sproutFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`fileSystems."/var/lib/docker"`,
+		"sdImage.expandOnBoot = false;",
+		"systemd.services.sprout-secrets",
+		`EnvironmentFile = "/var/lib/sprout/secrets/compose.env";`,
+	} {
+		if !strings.Contains(system, want) {
+			t.Errorf("system is missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/fcjr/sprout/internal/nix"
+	"github.com/spf13/cobra"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate [file]",
+	Short: "Check sprout.yaml for mistakes",
+	Long: `Validate checks sprout.yaml against the Sprout schema, rejecting unknown
+fields, and then checks the values the schema cannot: SSH keys are parsed,
+compose files have to exist and load, wireless SSIDs and passphrases have to
+be of valid length and the username must not be a system account.
+
+Every problem is reported with its file, line and column. The same checks run
+at the start of 'sprout seed'.
+
+If no file is specified, the config file is checked (see --config).`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runValidate,
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
+
+func runValidate(cmd *cobra.Command, args []string) error {
+	// Errors are printed as they happen, and are not about usage once the
+	// arguments are accepted
+	cmd.SilenceUsage, cmd.SilenceErrors = true, true
+	var filename string
+	if len(args) > 0 {
+		filename = args[0]
+	} else {
+		var err error
+		if filename, err = configFile(); err != nil {
+			return printError("%w", err)
+		}
+	}
+
+	nixInstance := newNix(false)
+	if err := validateConfig(nixInstance, filename); err != nil {
+		return err
+	}
+	printSuccess(fmt.Sprintf("✓ %s is valid", filepath.Base(filename)))
+	return nil
+}
+
+// validateConfig validates a sprout.yaml and prints every problem found.
+func validateConfig(nixInstance *nix.Nix, filename string) error {
+	err := nixInstance.Validate(filename)
+	var validationErr *nix.ValidationError
+	if !errors.As(err, &validationErr) {
+		if err != nil {
+			return printError("failed to validate %s: %w", filepath.Base(filename), err)
+		}
+		return nil
+	}
+
+	for _, problem := range validationErr.Problems {
+		fmt.Printf("  %s%s%s\n", Red, problem, Reset)
+	}
+	if len(validationErr.Problems) == 1 {
+		return printError("%s is not valid", filepath.Base(filename))
+	}
+	return printError("%s is not valid: %d problems found", filepath.Base(filename), len(validationErr.Problems))
+}
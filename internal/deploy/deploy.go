@@ -0,0 +1,212 @@
+package deploy
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fcjr/sprout/internal/nix"
+)
+
+// activateScript swaps in the uploaded version of a stack and restarts its
+// units, which only come up once every container is healthy. If they fail,
+// the previous version is put back and started again. It is run with the
+// stack's directory, the unit to restart and the units that must end up
+// active.
+const activateScript = `set -u
+dir=$1
+unit=$2
+shift 2
+
+restart() {
+  systemctl restart "$unit" || return 1
+  for u in "$@"; do
+    systemctl is-active --quiet "$u" || return 1
+  done
+}
+
+rm -rf "$dir.prev" "$dir.failed"
+if [ -d "$dir" ]; then
+  mv "$dir" "$dir.prev"
+fi
+mv "$dir.new" "$dir"
+
+if restart "$@"; then
+  exit 0
+fi
+
+echo "Health checks failed, rolling back" >&2
+systemctl status --no-pager --lines 20 "$unit" "$@" >&2
+mv "$dir" "$dir.failed"
+if [ -d "$dir.prev" ]; then
+  mv "$dir.prev" "$dir"
+fi
+if ! restart "$@"; then
+  echo "The previous version did not become healthy either" >&2
+fi
+exit 1
+`
+
+// Deployer pushes compose stacks to a running device.
+type Deployer struct {
+	Remote *Remote
+}
+
+// ExistingLayers returns the chain IDs of all image layers on the device.
+func (d *Deployer) ExistingLayers() (map[string]bool, error) {
+	output, err := d.Remote.Output(`ids=$(docker image ls -aq); if [ -n "$ids" ]; then docker image inspect --format '{{json .RootFS.Layers}}' $ids; fi`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images on the device: %w", err)
+	}
+	return existingChains(output)
+}
+
+// LoadImage loads an image into the device's Docker daemon, sending only
+// the layers it does not have yet. It returns how many layers were sent.
+func (d *Deployer) LoadImage(img nix.DockerImage, existing map[string]bool) (int, error) {
+	skip, total, err := missingLayers(img.TarPath, existing)
+	if err != nil {
+		return 0, err
+	}
+
+	err = d.load(img.TarPath, skip)
+	if err != nil && len(skip) > 0 {
+		// Daemons using the containerd image store want every blob
+		fmt.Printf("      \033[33mPartial load failed, sending the full image\033[0m\n")
+		skip = nil
+		err = d.load(img.TarPath, skip)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to load %s on the device: %w", img.Name, err)
+	}
+	return total - len(skip), nil
+}
+
+func (d *Deployer) load(archivePath string, skip map[string]bool) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeFilteredArchive(archivePath, skip, writer))
+	}()
+	defer reader.Close()
+
+	return d.Remote.Run("docker load --quiet", reader, io.Discard)
+}
+
+// UploadStack copies the stack's compose file and project files to a
+// staging directory next to where the deployed stack lives.
+func (d *Deployer) UploadStack(stack nix.DockerComposeConfig) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeStackArchive(stack, writer))
+	}()
+	defer reader.Close()
+
+	staging := shellQuote(stack.DeployedDir() + ".new")
+	command := fmt.Sprintf("rm -rf %s && mkdir -p %s && tar -x -C %s", staging, staging, staging)
+	if err := d.Remote.Run(command, reader, io.Discard); err != nil {
+		return fmt.Errorf("failed to upload stack %s: %w", stack.Name, err)
+	}
+	return nil
+}
+
+// Activate switches the device to the uploaded version of the stack and
+// rolls back if it does not become healthy.
+func (d *Deployer) Activate(stack nix.DockerComposeConfig) error {
+	args := []string{stack.DeployedDir(), stack.Unit()}
+	if stack.UnitPerService() {
+		for _, service := range stack.Services {
+			args = append(args, stack.ServiceUnit(service.Name)+".service")
+		}
+	} else {
+		args = append(args, stack.Unit())
+	}
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	command := "sh -s -- " + strings.Join(quoted, " ")
+	if err := d.Remote.Run(command, strings.NewReader(activateScript), os.Stdout); err != nil {
+		return fmt.Errorf("stack %s failed to start and was rolled back: %w", stack.Name, err)
+	}
+	return nil
+}
+
+// writeStackArchive writes the stack's compose file and the project files
+// it references as a tar archive.
+func writeStackArchive(stack nix.DockerComposeConfig, w io.Writer) error {
+	writer := tar.NewWriter(w)
+
+	content := []byte(stack.ModifiedContent)
+	if err := writer.WriteHeader(&tar.Header{
+		Name: "docker-compose.yaml",
+		Mode: 0644,
+		Size: int64(len(content)),
+	}); err != nil {
+		return err
+	}
+	if _, err := writer.Write(content); err != nil {
+		return err
+	}
+
+	if stack.AssetsPath != "" {
+		filesDir := filepath.Join(stack.AssetsPath, "files")
+		if _, err := os.Stat(filesDir); err == nil {
+			if err := addTree(writer, filesDir); err != nil {
+				return fmt.Errorf("failed to archive project files: %w", err)
+			}
+		}
+	}
+
+	return writer.Close()
+}
+
+// addTree adds the contents of dir to the archive, keeping symlinks.
+func addTree(writer *tar.Writer, dir string) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(writer, file)
+		return err
+	})
+}
@@ -0,0 +1,163 @@
+package deploy
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// archiveManifest is an entry of manifest.json in a `docker save` archive.
+type archiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// imageConfig is the part of an image config that identifies its layers.
+type imageConfig struct {
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// chainIDs returns the chain ID of every layer prefix of an image. Docker
+// identifies a layer by its chain ID, since the same diff on top of a
+// different parent is a different layer.
+func chainIDs(diffIDs []string) []string {
+	chains := make([]string, len(diffIDs))
+	for i, diffID := range diffIDs {
+		if i == 0 {
+			chains[i] = diffID
+			continue
+		}
+		sum := sha256.Sum256([]byte(chains[i-1] + " " + diffID))
+		chains[i] = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	return chains
+}
+
+// existingChains parses the output of `docker image inspect --format
+// '{{json .RootFS.Layers}}'`, one JSON array of diff IDs per line, into the
+// set of layer chain IDs present on the device.
+func existingChains(output string) (map[string]bool, error) {
+	existing := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "null" {
+			continue
+		}
+		var diffIDs []string
+		if err := json.Unmarshal([]byte(line), &diffIDs); err != nil {
+			return nil, fmt.Errorf("failed to parse image layers: %w", err)
+		}
+		for _, chainID := range chainIDs(diffIDs) {
+			existing[chainID] = true
+		}
+	}
+	return existing, nil
+}
+
+// missingLayers works out which layer files of a `docker save` archive have
+// to be sent to a device that already has the existing layer chains. It
+// returns the files that can be left out and the total number of layers.
+func missingLayers(archivePath string, existing map[string]bool) (map[string]bool, int, error) {
+	var manifests []archiveManifest
+	if err := readArchiveFile(archivePath, "manifest.json", &manifests); err != nil {
+		return nil, 0, err
+	}
+
+	skip := make(map[string]bool)
+	needed := make(map[string]bool)
+	total := 0
+	for _, manifest := range manifests {
+		var config imageConfig
+		if err := readArchiveFile(archivePath, manifest.Config, &config); err != nil {
+			return nil, 0, err
+		}
+		diffIDs := config.RootFS.DiffIDs
+		if len(diffIDs) != len(manifest.Layers) {
+			return nil, 0, fmt.Errorf("image %s lists %d layers but has %d diff IDs",
+				manifest.Config, len(manifest.Layers), len(diffIDs))
+		}
+
+		for i, chainID := range chainIDs(diffIDs) {
+			total++
+			if existing[chainID] {
+				skip[manifest.Layers[i]] = true
+			} else {
+				needed[manifest.Layers[i]] = true
+			}
+		}
+	}
+
+	// A file shared by several layers has to be sent if any of them is missing
+	for path := range needed {
+		delete(skip, path)
+	}
+	return skip, total, nil
+}
+
+// readArchiveFile decodes the JSON file name from a tar archive.
+func readArchiveFile(archivePath, name string, v any) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open image archive: %w", err)
+	}
+	defer file.Close()
+
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s not found in image archive %s", name, archivePath)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read image archive: %w", err)
+		}
+		if header.Name != name {
+			continue
+		}
+		if err := json.NewDecoder(reader).Decode(v); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		return nil
+	}
+}
+
+// writeFilteredArchive copies a `docker save` archive to w, leaving out the
+// files in skip. docker load does not read the file of a layer whose chain
+// ID it already has, so the result loads as long as those layers exist.
+func writeFilteredArchive(archivePath string, skip map[string]bool, w io.Writer) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open image archive: %w", err)
+	}
+	defer file.Close()
+
+	reader := tar.NewReader(file)
+	writer := tar.NewWriter(w)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read image archive: %w", err)
+		}
+		if skip[header.Name] {
+			continue
+		}
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(writer, reader); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
@@ -0,0 +1,95 @@
+package deploy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Remote runs commands on a device through the system ssh client, so the
+// user's keys, agent and ssh_config apply. Commands share one connection.
+type Remote struct {
+	Target string
+	Port   int
+	// Options are extra ssh options, e.g. StrictHostKeyChecking=no.
+	Options []string
+
+	controlPath string
+}
+
+// NewRemote returns a Remote for target, which is host or user@host.
+func NewRemote(target string, port int) *Remote {
+	return &Remote{
+		Target: target,
+		Port:   port,
+		// Kept short: control sockets are limited to about 100 bytes
+		controlPath: "/tmp/sprout-ssh-%C",
+	}
+}
+
+func (r *Remote) sshArgs(command string) []string {
+	args := []string{
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=10",
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=" + r.controlPath,
+		"-o", "ControlPersist=60",
+	}
+	for _, option := range r.Options {
+		args = append(args, "-o", option)
+	}
+	if r.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(r.Port))
+	}
+	return append(args, r.Target, command)
+}
+
+// Run runs command on the device, streaming stdin to it and its output to
+// stdout. Remote errors go to the local stderr.
+func (r *Remote) Run(command string, stdin io.Reader, stdout io.Writer) error {
+	cmd := exec.Command("ssh", r.sshArgs(command)...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ssh %s: %w", r.Target, err)
+	}
+	return nil
+}
+
+// Output runs command on the device and returns its output.
+func (r *Remote) Output(command string) (string, error) {
+	var stdout bytes.Buffer
+	if err := r.Run(command, nil, &stdout); err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// ConnectionLost reports whether err is from a command whose ssh
+// connection dropped, rather than from the command itself.
+func ConnectionLost(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == 255
+}
+
+// Close shuts down the shared connection.
+func (r *Remote) Close() error {
+	args := []string{"-o", "ControlPath=" + r.controlPath, "-O", "exit"}
+	if r.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(r.Port))
+	}
+	args = append(args, r.Target)
+	cmd := exec.Command("ssh", args...)
+	return cmd.Run()
+}
+
+// shellQuote quotes s for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
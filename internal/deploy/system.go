@@ -0,0 +1,74 @@
+package deploy
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sproutSystem is the helper installed in the image that activates,
+// confirms and rolls back systems pushed by `sprout upgrade`.
+const sproutSystem = "sudo /run/current-system/sw/bin/sprout-system"
+
+// MissingPaths returns the store paths the device does not have yet.
+func (d *Deployer) MissingPaths(paths []string) ([]string, error) {
+	var stdout strings.Builder
+	stdin := strings.NewReader(strings.Join(paths, "\n") + "\n")
+	if err := d.Remote.Run("xargs nix-store --check-validity --print-invalid", stdin, &stdout); err != nil {
+		return nil, fmt.Errorf("failed to check store paths on the device: %w", err)
+	}
+	return strings.Fields(stdout.String()), nil
+}
+
+// ImportPaths imports store paths in the `nix-store --export` format into
+// the device's store.
+func (d *Deployer) ImportPaths(export io.Reader) error {
+	if err := d.Remote.Run("nix-store --import >/dev/null", export, nil); err != nil {
+		return fmt.Errorf("failed to import store paths on the device: %w", err)
+	}
+	return nil
+}
+
+// SwitchSystem activates toplevel on the device. Unless it is confirmed
+// within timeout, the device switches back to its previous system.
+func (d *Deployer) SwitchSystem(toplevel string, timeout time.Duration) error {
+	seconds := strconv.Itoa(int(timeout.Seconds()))
+	err := d.Remote.Run(sproutSystem+" switch "+shellQuote(toplevel)+" "+seconds, nil, nil)
+	if err != nil && !ConnectionLost(err) {
+		return fmt.Errorf("failed to activate the new system: %w", err)
+	}
+	// Activation may restart the network or sshd and drop the connection;
+	// the health check tells whether it worked.
+	return nil
+}
+
+// WaitHealthy polls the device until the units Sprout runs are up, or until
+// deadline.
+func (d *Deployer) WaitHealthy(deadline time.Time) bool {
+	for time.Now().Before(deadline) {
+		if err := d.Remote.Run(sproutSystem+" health", nil, io.Discard); err == nil {
+			return true
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return false
+}
+
+// ConfirmSystem makes the active system the boot default.
+func (d *Deployer) ConfirmSystem() error {
+	if err := d.Remote.Run(sproutSystem+" confirm", nil, nil); err != nil {
+		return fmt.Errorf("failed to confirm the new system: %w", err)
+	}
+	return nil
+}
+
+// RollbackSystem switches back to the system that was active before the
+// upgrade.
+func (d *Deployer) RollbackSystem() error {
+	if err := d.Remote.Run(sproutSystem+" rollback", nil, nil); err != nil {
+		return fmt.Errorf("failed to roll back: %w", err)
+	}
+	return nil
+}
@@ -228,6 +228,22 @@ func DiscoverWithDebug(ctx context.Context, debug bool) ([]Node, error) {
 	}
 }
 
+// Find looks for the node advertising the given name.
+func Find(ctx context.Context, name string) (*Node, error) {
+	nodes, err := Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		instance, _, _ := strings.Cut(node.Hostname, ".")
+		instance = strings.ReplaceAll(instance, `\ `, " ")
+		if strings.EqualFold(instance, name) || strings.HasSuffix(strings.ToLower(instance), " "+strings.ToLower(name)) {
+			return &node, nil
+		}
+	}
+	return nil, fmt.Errorf("no Sprout node named %s found on the network", name)
+}
+
 // getLocalIPs returns the local IP addresses that can be used for mDNS
 func getLocalIPs() ([]net.IP, error) {
 	var ips []net.IP
@@ -0,0 +1,186 @@
+package nix
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/compose-spec/compose-go/v2/types"
+)
+
+// composeAssetsDir is where project files referenced by the compose file
+// are staged before being added to the image, beneath the build's staging
+// directory and suffixed with the stack name. On the device they are copied
+// beneath the stack's working directory.
+const composeAssetsDir = "compose-assets"
+
+// SeededVolume is a named compose volume that is populated from a
+// directory the first time it is created on the device.
+type SeededVolume struct {
+	Key  string
+	Name string
+}
+
+// collectComposeAssets finds bind mount sources and config/secret files
+// that live inside the project directory, stages them for embedding, and
+// rewrites the project to reference their location on the device. Compose
+// secrets named in the encrypted secrets file point at the installed
+// secret instead.
+func (n *Nix) collectComposeAssets(dockerConfig *DockerComposeConfig, secrets *SecretsConfig, project *types.Project, configDir string) error {
+	dockerConfig.Assets = nil
+	dockerConfig.SeededVolumes = nil
+	dockerConfig.AssetsPath = ""
+
+	stagingDir, err := n.stagingDir()
+	if err != nil {
+		return err
+	}
+	assetsPath := filepath.Join(stagingDir, composeAssetsDir+"-"+dockerConfig.Name)
+	if err := os.RemoveAll(assetsPath); err != nil {
+		return fmt.Errorf("failed to clear assets directory: %w", err)
+	}
+
+	assets := make(map[string]bool)
+	embed := func(source string) (string, error) {
+		rel, err := filepath.Rel(project.WorkingDir, source)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			// Host paths such as /var/run/docker.sock are expected to exist on
+			// the device; only flag siblings of the project, which were most
+			// likely written as ../relative paths.
+			if sibling, err := filepath.Rel(filepath.Dir(project.WorkingDir), source); err == nil && !strings.HasPrefix(sibling, "..") {
+				fmt.Printf("      \033[33mWarning: %s is outside the compose project directory and was not embedded\033[0m\n", source)
+			}
+			return source, nil
+		}
+
+		if _, err := os.Stat(source); err == nil && !assets[rel] {
+			if err := n.copyTree(source, filepath.Join(assetsPath, "files", rel)); err != nil {
+				return "", fmt.Errorf("failed to embed %s: %w", source, err)
+			}
+			assets[rel] = true
+		}
+		return filepath.Join(dockerConfig.deviceDir(), rel), nil
+	}
+
+	for serviceName, service := range project.Services {
+		for i, volume := range service.Volumes {
+			if volume.Type != types.VolumeTypeBind || !filepath.IsAbs(volume.Source) {
+				continue
+			}
+			source, err := embed(volume.Source)
+			if err != nil {
+				return err
+			}
+			service.Volumes[i].Source = source
+		}
+		project.Services[serviceName] = service
+	}
+
+	for name, config := range project.Configs {
+		if config.File == "" {
+			continue
+		}
+		file, err := embed(config.File)
+		if err != nil {
+			return err
+		}
+		config.File = file
+		project.Configs[name] = config
+	}
+
+	for name, secret := range project.Secrets {
+		if secrets.Has(name) {
+			secret.File = filepath.Join(deviceSecretsDir, name)
+			secret.Environment = ""
+			project.Secrets[name] = secret
+			continue
+		}
+		if secret.File == "" {
+			continue
+		}
+		file, err := embed(secret.File)
+		if err != nil {
+			return err
+		}
+		secret.File = file
+		project.Secrets[name] = secret
+	}
+
+	for key, seedDir := range dockerConfig.VolumeSeeds {
+		volume, ok := project.Volumes[key]
+		if !ok {
+			return fmt.Errorf("docker_compose.volume_seeds references unknown volume %q", key)
+		}
+		if volume.External || (volume.Driver != "" && volume.Driver != "local") {
+			return fmt.Errorf("volume %q cannot be seeded: only local, non-external volumes are supported", key)
+		}
+
+		source := resolvePaths(configDir, []string{seedDir})[0]
+		if err := n.copyTree(source, filepath.Join(assetsPath, "volumes", key)); err != nil {
+			return fmt.Errorf("failed to stage seed data for volume %q: %w", key, err)
+		}
+		dockerConfig.SeededVolumes = append(dockerConfig.SeededVolumes, SeededVolume{
+			Key:  key,
+			Name: volume.Name,
+		})
+	}
+	sort.Slice(dockerConfig.SeededVolumes, func(i, j int) bool {
+		return dockerConfig.SeededVolumes[i].Key < dockerConfig.SeededVolumes[j].Key
+	})
+
+	for rel := range assets {
+		dockerConfig.Assets = append(dockerConfig.Assets, rel)
+	}
+	sort.Strings(dockerConfig.Assets)
+
+	if len(dockerConfig.Assets) > 0 || len(dockerConfig.SeededVolumes) > 0 {
+		dockerConfig.AssetsPath = assetsPath
+		fmt.Printf("      \033[36mEmbedding %d project file(s) and %d volume seed(s)\033[0m\n",
+			len(dockerConfig.Assets), len(dockerConfig.SeededVolumes))
+	}
+	return nil
+}
+
+// copyTree copies a file or directory, preserving permissions and symlinks.
+func (n *Nix) copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := n.copyFile(path, target); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		default:
+			return nil
+		}
+	})
+}
@@ -0,0 +1,344 @@
+package nix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// ContainerEngine runs the containers used by Docker-based builds.
+type ContainerEngine interface {
+	// Pull fetches an image for the engine's default platform.
+	Pull(ctx context.Context, image string) error
+	// Run runs a container to completion and returns its output. With
+	// stream set the output is shown while the container runs.
+	Run(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, stream bool) (string, error)
+}
+
+// Builder turns generated Nix files into images.
+type Builder interface {
+	// BuildImage builds the SD card image of a Nix file and returns the path
+	// of the image or of the directory containing it.
+	BuildImage(filename string, sproutFile *SproutFile) (string, error)
+	// BuildSproutBinary cross-compiles the Sprout binary embedded in images
+	// and returns its path, inside a directory of its own.
+	BuildSproutBinary() (string, error)
+	// InstallSecrets copies the staged secrets in dir into the root
+	// filesystem of a built image.
+	InstallSecrets(imagePath, dir string) error
+}
+
+// ImageFetcher produces the Docker images embedded in an image.
+type ImageFetcher interface {
+	// Build builds a compose service with docker-compose.
+	Build(service string, invocation *ComposeInvocation) error
+	// Pull pulls an image, preferring its ARM64 variant.
+	Pull(ctx context.Context, name string) error
+	// Save tags an image with its local tag and writes it to its tar path.
+	Save(ctx context.Context, img DockerImage) error
+}
+
+func (n *Nix) engine() ContainerEngine {
+	if n.Engine != nil {
+		return n.Engine
+	}
+	return dockerEngine{}
+}
+
+func (n *Nix) builder() Builder {
+	if n.Builder != nil {
+		return n.Builder
+	}
+	return cliBuilder{n}
+}
+
+func (n *Nix) fetcher() ImageFetcher {
+	if n.Fetcher != nil {
+		return n.Fetcher
+	}
+	return dockerFetcher{}
+}
+
+func newDockerClient() (*client.Client, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	return cli, nil
+}
+
+// dockerEngine runs containers with the local Docker daemon.
+type dockerEngine struct{}
+
+func (dockerEngine) Pull(ctx context.Context, name string) error {
+	cli, err := newDockerClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	reader, err := cli.ImagePull(ctx, name, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to pull %s: %w", name, err)
+	}
+	defer reader.Close()
+	io.Copy(io.Discard, reader)
+	return nil
+}
+
+func (dockerEngine) Run(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, stream bool) (string, error) {
+	cli, err := newDockerClient()
+	if err != nil {
+		return "", err
+	}
+	defer cli.Close()
+
+	resp, err := cli.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to create container: %w", err)
+	}
+	if !hostConfig.AutoRemove {
+		defer cli.ContainerRemove(ctx, resp.ID, container.RemoveOptions{RemoveVolumes: true, Force: true})
+	}
+
+	if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		return "", fmt.Errorf("failed to start container: %w", err)
+	}
+
+	if stream {
+		return streamContainerLogs(ctx, cli, resp.ID)
+	}
+
+	statusCh, errCh := cli.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return "", fmt.Errorf("error waiting for container: %w", err)
+		}
+	case status := <-statusCh:
+		if status.StatusCode != 0 {
+			return "", fmt.Errorf("container exited with code %d\nOutput: %s",
+				status.StatusCode, containerOutput(ctx, cli, resp.ID))
+		}
+	}
+	return containerOutput(ctx, cli, resp.ID), nil
+}
+
+func streamContainerLogs(ctx context.Context, cli *client.Client, containerID string) (string, error) {
+	logs, err := cli.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get container logs: %w", err)
+	}
+
+	var buildOutput strings.Builder
+	done := make(chan struct{})
+	go func() {
+		processDockerLogs(logs, &buildOutput)
+		close(done)
+	}()
+
+	statusCh, errCh := cli.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		logs.Close()
+		<-done
+		if err != nil {
+			return "", fmt.Errorf("error waiting for container: %w", err)
+		}
+	case status := <-statusCh:
+		logs.Close()
+		<-done
+		if status.StatusCode != 0 {
+			return "", fmt.Errorf("container exited with code %d", status.StatusCode)
+		}
+	}
+
+	return buildOutput.String(), nil
+}
+
+func processDockerLogs(logs io.ReadCloser, buildOutput *strings.Builder) {
+	defer finishStreamingDisplay()
+
+	for {
+		header := make([]byte, 8)
+		n, err := io.ReadFull(logs, header)
+		if err != nil || n != 8 {
+			break
+		}
+
+		payloadSize := int(header[4])<<24 | int(header[5])<<16 | int(header[6])<<8 | int(header[7])
+
+		if payloadSize <= 0 {
+			continue
+		}
+
+		payload := make([]byte, payloadSize)
+		n, err = io.ReadFull(logs, payload)
+		if err != nil || n != payloadSize {
+			break
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(payload))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" {
+				buildOutput.WriteString(line + "\n")
+				displayStreamingLine(line, "\033[36m")
+			}
+		}
+	}
+}
+
+func containerOutput(ctx context.Context, cli *client.Client, containerID string) string {
+	logs, err := cli.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+	})
+	if err != nil {
+		return ""
+	}
+	defer logs.Close()
+
+	var output bytes.Buffer
+	stdcopy.StdCopy(&output, &output, logs)
+	return output.String()
+}
+
+// cliBuilder builds with nix-build, locally if Nix is installed and in the
+// Nix builder container otherwise.
+type cliBuilder struct {
+	n *Nix
+}
+
+func (b cliBuilder) BuildImage(filename string, sproutFile *SproutFile) (string, error) {
+	isDisabled := os.Getenv("SPROUT_DISABLE_LOCAL_NIX") != ""
+	nixPath, hasNix := exec.LookPath("nix-build")
+
+	if !isDisabled && hasNix == nil {
+		fmt.Printf("      \033[36mUsing local Nix installation for faster builds...\033[0m\n")
+		return b.n.buildLocal(nixPath, filename, sproutFile)
+	}
+
+	fmt.Printf("      \033[36mNix not found locally, using Docker build...\033[0m\n")
+	return b.n.buildWithDocker(filename, sproutFile)
+}
+
+func (b cliBuilder) InstallSecrets(imagePath, dir string) error {
+	if debugfsPath, err := exec.LookPath("debugfs"); err == nil {
+		return b.n.installSecretsLocal(debugfsPath, imagePath, dir)
+	}
+	fmt.Printf("      \033[36mdebugfs not found locally, using Docker...\033[0m\n")
+	return b.n.installSecretsWithDocker(imagePath, dir)
+}
+
+func (b cliBuilder) BuildSproutBinary() (string, error) {
+	fmt.Printf("      \033[36mBuilding Sprout binary for ARM64...\033[0m\n")
+
+	tempDir, err := os.MkdirTemp("", "sprout-binary-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp dir: %w", err)
+	}
+
+	binaryPath := filepath.Join(tempDir, "sprout")
+	cmd := exec.Command("go", "build", "-o", binaryPath, "./cmd/sprout/main.go")
+	cmd.Dir = "/Users/fcjr/git/sprout"
+	cmd.Env = append(os.Environ(),
+		"GOOS=linux",
+		"GOARCH=arm64",
+		"CGO_ENABLED=0",
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return "", fmt.Errorf("failed to build Sprout binary: %w\nOutput: %s", err, output)
+	}
+
+	fmt.Printf("      \033[32m✓ Sprout binary built for ARM64\033[0m\n")
+	return binaryPath, nil
+}
+
+// dockerFetcher builds images with docker-compose and pulls and saves them
+// with the local Docker daemon.
+type dockerFetcher struct{}
+
+func (dockerFetcher) Build(service string, invocation *ComposeInvocation) error {
+	args := append(append([]string{}, invocation.Args...), "build", service)
+	cmd := exec.Command("docker-compose", args...)
+	cmd.Dir = invocation.WorkingDir
+	cmd.Env = invocation.Env
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to build service %s: %w", service, err)
+	}
+	return nil
+}
+
+func (dockerFetcher) Pull(ctx context.Context, name string) error {
+	cli, err := newDockerClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	reader, err := cli.ImagePull(ctx, name, image.PullOptions{Platform: "linux/arm64"})
+	if err == nil {
+		fmt.Printf("      Successfully pulled ARM64 image: %s\n", name)
+		io.Copy(io.Discard, reader)
+		reader.Close()
+		return nil
+	}
+
+	fmt.Printf("      ARM64 image not available, trying default platform: %s\n", name)
+	reader, err = cli.ImagePull(ctx, name, image.PullOptions{})
+	if err != nil {
+		fmt.Printf("Warning: failed to pull image %s, assuming it exists locally: %v\n", name, err)
+		return nil
+	}
+	io.Copy(io.Discard, reader)
+	reader.Close()
+	return nil
+}
+
+func (dockerFetcher) Save(ctx context.Context, img DockerImage) error {
+	cli, err := newDockerClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	if err := cli.ImageTag(ctx, img.Name, img.LocalTag); err != nil {
+		return fmt.Errorf("failed to tag image %s as %s: %w", img.Name, img.LocalTag, err)
+	}
+
+	reader, err := cli.ImageSave(ctx, []string{img.LocalTag})
+	if err != nil {
+		return fmt.Errorf("failed to save image %s: %w", img.LocalTag, err)
+	}
+	defer reader.Close()
+
+	tarFile, err := os.Create(img.TarPath)
+	if err != nil {
+		return fmt.Errorf("failed to create tar file %s: %w", img.TarPath, err)
+	}
+	defer tarFile.Close()
+
+	if _, err := io.Copy(tarFile, reader); err != nil {
+		return fmt.Errorf("failed to write image to tar file %s: %w", img.TarPath, err)
+	}
+	return nil
+}
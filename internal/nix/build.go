@@ -5,19 +5,28 @@ import (
 	_ "embed"
 	"fmt"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"text/template"
 )
 
 //go:embed image.nix.tmpl
 var imageNixTemplate string
 
+//go:embed test.nix.tmpl
+var testNixTemplate string
+
 func (n *Nix) GenerateImage(sproutFile SproutFile) (string, error) {
-	tmpl, err := template.New("image").Parse(imageNixTemplate)
+	tmpl, err := template.New("image").Funcs(template.FuncMap{
+		"python":      pythonString,
+		"nixString":   nixString,
+		"dataLabel":   func() string { return dataLabel },
+		"dockerLabel": func() string { return dockerLabel },
+	}).Parse(imageNixTemplate)
 	if err != nil {
 		return "", err
 	}
+	if _, err := tmpl.Parse(testNixTemplate); err != nil {
+		return "", err
+	}
 
 	var buf bytes.Buffer
 	err = tmpl.Execute(&buf, sproutFile)
@@ -28,42 +37,35 @@ func (n *Nix) GenerateImage(sproutFile SproutFile) (string, error) {
 	return buf.String(), nil
 }
 
+// BuildSproutBinary cross-compiles the Sprout binary for ARM64 devices.
 func (n *Nix) BuildSproutBinary() (string, error) {
-	fmt.Printf("      \033[36mBuilding Sprout binary for ARM64...\033[0m\n")
-
-	tempDir, err := os.MkdirTemp("", "sprout-binary-*")
-	if err != nil {
-		return "", fmt.Errorf("failed to create temp dir: %w", err)
-	}
+	return n.builder().BuildSproutBinary()
+}
 
-	binaryPath := filepath.Join(tempDir, "sprout")
-	cmd := exec.Command("go", "build", "-o", binaryPath, "./cmd/sprout/main.go")
-	cmd.Dir = "/Users/fcjr/git/sprout"
-	cmd.Env = append(os.Environ(),
-		"GOOS=linux",
-		"GOARCH=arm64",
-		"CGO_ENABLED=0",
-	)
+// Build builds the SD card image of the given Nix file.
+func (n *Nix) Build(filename string, sproutFile *SproutFile) (string, error) {
+	return n.builder().BuildImage(filename, sproutFile)
+}
 
-	output, err := cmd.CombinedOutput()
+// stagingDir returns WorkDir, creating a temporary one if it is not set.
+func (n *Nix) stagingDir() (string, error) {
+	if n.WorkDir != "" {
+		return n.WorkDir, os.MkdirAll(n.WorkDir, 0755)
+	}
+	dir, err := os.MkdirTemp("", "sprout-build-*")
 	if err != nil {
-		os.RemoveAll(tempDir)
-		return "", fmt.Errorf("failed to build Sprout binary: %w\nOutput: %s", err, output)
+		return "", fmt.Errorf("failed to create build directory: %w", err)
 	}
-
-	fmt.Printf("      \033[32m✓ Sprout binary built for ARM64\033[0m\n")
-	return binaryPath, nil
+	n.WorkDir, n.tempDir = dir, dir
+	return dir, nil
 }
 
-func (n *Nix) Build(filename string, sproutFile *SproutFile) (string, error) {
-	isDisabled := os.Getenv("SPROUT_DISABLE_LOCAL_NIX") != ""
-	nixPath, hasNix := exec.LookPath("nix-build")
-
-	if !isDisabled && hasNix == nil {
-		fmt.Printf("      \033[36mUsing local Nix installation for faster builds...\033[0m\n")
-		return n.buildLocal(nixPath, filename, sproutFile)
+// Close removes the temporary files staged for builds.
+func (n *Nix) Close() error {
+	if n.tempDir == "" {
+		return nil
 	}
-
-	fmt.Printf("      \033[36mNix not found locally, using Docker build...\033[0m\n")
-	return n.buildWithDocker(filename, sproutFile)
+	err := os.RemoveAll(n.tempDir)
+	n.WorkDir, n.tempDir = "", ""
+	return err
 }
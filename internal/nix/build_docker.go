@@ -1,18 +1,14 @@
 package nix
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/mount"
-	"github.com/docker/docker/client"
 
 	configpkg "github.com/fcjr/sprout/internal/config"
 )
@@ -30,19 +26,16 @@ func (n *Nix) buildWithDocker(filename string, sproutFile *SproutFile) (string,
 
 	n.printDockerBuildInfo()
 
-	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	containerConfig, hostConfig, err := n.createDockerConfigs(tempDir, []string{"nix-build", "--cores", "0", "--max-jobs", "auto", "--no-link", "-A", "sdImage", "/workspace/image.nix"})
 	if err != nil {
-		return "", fmt.Errorf("failed to create Docker client: %w", err)
+		return "", err
 	}
-	defer cli.Close()
 
-	containerConfig, hostConfig, err := n.createDockerConfigs(tempDir)
+	output, err := n.engine().Run(context.Background(), containerConfig, hostConfig, true)
 	if err != nil {
 		return "", err
 	}
-
-	nixStorePath, err := n.runDockerBuild(ctx, cli, containerConfig, hostConfig)
+	nixStorePath, err := n.extractNixStorePath(output)
 	if err != nil {
 		return "", err
 	}
@@ -76,11 +69,17 @@ func (n *Nix) prepareDockerBuildDir(filename string, sproutFile *SproutFile) (st
 }
 
 func (n *Nix) copyDockerImages(sproutFile *SproutFile, tempDir, nixFileInTemp string) error {
-	if !sproutFile.DockerCompose.Enabled {
-		return nil
+	for _, stack := range sproutFile.DockerCompose.Enabled() {
+		if err := n.copyIntoBuildDir(stack.AssetsPath, tempDir, nixFileInTemp); err != nil {
+			return err
+		}
+	}
+
+	if sproutFile.UsesDataRoot() {
+		return n.copyIntoBuildDir(sproutFile.DataRootPath, tempDir, nixFileInTemp)
 	}
 
-	for _, img := range sproutFile.DockerCompose.Images {
+	for _, img := range sproutFile.Images {
 		if _, err := os.Stat(img.TarPath); err == nil {
 			tarFileName := filepath.Base(img.TarPath)
 			destPath := filepath.Join(tempDir, tarFileName)
@@ -96,16 +95,31 @@ func (n *Nix) copyDockerImages(sproutFile *SproutFile, tempDir, nixFileInTemp st
 	return nil
 }
 
+func (n *Nix) copyIntoBuildDir(path, tempDir, nixFileInTemp string) error {
+	if path == "" {
+		return nil
+	}
+
+	fileName := filepath.Base(path)
+	if err := n.copyTree(path, filepath.Join(tempDir, fileName)); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", path, err)
+	}
+	if err := n.updateTarPathInNixFile(nixFileInTemp, path, filepath.Join("/workspace", fileName)); err != nil {
+		return fmt.Errorf("failed to update path in nix file: %w", err)
+	}
+	return nil
+}
+
 func (n *Nix) printDockerBuildInfo() {
 	fmt.Printf("      \033[36mThis may take 2-8 minutes (optimized with parallel builds)...\033[0m\n")
 	fmt.Printf("      \033[36mBuilding with Docker Linux container (4GB RAM, multi-core)...\033[0m\n")
 	fmt.Printf("      \033[36mUsing persistent Nix store cache for faster subsequent builds...\033[0m\n")
 }
 
-func (n *Nix) createDockerConfigs(tempDir string) (*container.Config, *container.HostConfig, error) {
+func (n *Nix) createDockerConfigs(tempDir string, cmd []string) (*container.Config, *container.HostConfig, error) {
 	containerConfig := &container.Config{
 		Image:      "nixos/nix:latest",
-		Cmd:        []string{"nix-build", "--cores", "0", "--max-jobs", "auto", "--no-link", "/workspace/image.nix"},
+		Cmd:        cmd,
 		WorkingDir: "/workspace",
 		Env: []string{
 			"PATH=/root/.nix-profile/bin:/nix/var/nix/profiles/default/bin:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
@@ -158,82 +172,6 @@ func (n *Nix) createDockerConfigs(tempDir string) (*container.Config, *container
 	return containerConfig, hostConfig, nil
 }
 
-func (n *Nix) runDockerBuild(ctx context.Context, cli *client.Client, containerConfig *container.Config, hostConfig *container.HostConfig) (string, error) {
-	resp, err := cli.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, "")
-	if err != nil {
-		return "", fmt.Errorf("failed to create container: %w", err)
-	}
-
-	if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
-		return "", fmt.Errorf("failed to start container: %w", err)
-	}
-
-	return n.streamDockerLogs(ctx, cli, resp.ID)
-}
-
-func (n *Nix) streamDockerLogs(ctx context.Context, cli *client.Client, containerID string) (string, error) {
-	logs, err := cli.ContainerLogs(ctx, containerID, container.LogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Follow:     true,
-	})
-	if err != nil {
-		return "", fmt.Errorf("failed to get container logs: %w", err)
-	}
-
-	var buildOutput strings.Builder
-	go n.processDockerLogs(logs, &buildOutput)
-
-	statusCh, errCh := cli.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
-	select {
-	case err := <-errCh:
-		logs.Close()
-		if err != nil {
-			return "", fmt.Errorf("error waiting for container: %w", err)
-		}
-	case status := <-statusCh:
-		logs.Close()
-		if status.StatusCode != 0 {
-			return "", fmt.Errorf("container exited with code %d", status.StatusCode)
-		}
-	}
-
-	return n.extractNixStorePath(buildOutput.String())
-}
-
-func (n *Nix) processDockerLogs(logs io.ReadCloser, buildOutput *strings.Builder) {
-	defer finishStreamingDisplay()
-
-	for {
-		header := make([]byte, 8)
-		n, err := io.ReadFull(logs, header)
-		if err != nil || n != 8 {
-			break
-		}
-
-		payloadSize := int(header[4])<<24 | int(header[5])<<16 | int(header[6])<<8 | int(header[7])
-
-		if payloadSize <= 0 {
-			continue
-		}
-
-		payload := make([]byte, payloadSize)
-		n, err = io.ReadFull(logs, payload)
-		if err != nil || n != payloadSize {
-			break
-		}
-
-		scanner := bufio.NewScanner(bytes.NewReader(payload))
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			if line != "" {
-				buildOutput.WriteString(line + "\n")
-				displayStreamingLine(line, "\033[36m")
-			}
-		}
-	}
-}
-
 func (n *Nix) extractNixStorePath(output string) (string, error) {
 	lines := strings.Split(strings.TrimSpace(output), "\n")
 	var nixStorePath string
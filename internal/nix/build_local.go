@@ -17,7 +17,7 @@ func (n *Nix) buildLocal(nixPath, filename string, sproutFile *SproutFile) (stri
 
 	fmt.Printf("      \033[36mBuilding NixOS image locally...\033[0m\n")
 
-	cmd := exec.Command(nixPath, "--cores", "0", "--max-jobs", "auto", "--no-link", absNixFile)
+	cmd := exec.Command(nixPath, "--cores", "0", "--max-jobs", "auto", "--no-link", "-A", "sdImage", absNixFile)
 	cmd.Env = append(os.Environ(),
 		"NIX_BUILD_CORES=0",
 		"NIX_CONFIG=cores = 0\nmax-jobs = auto\nsubstituters = https://cache.nixos.org\ntrusted-public-keys = cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY=",
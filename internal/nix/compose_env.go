@@ -0,0 +1,168 @@
+package nix
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/compose-spec/compose-go/v2/loader"
+	"github.com/compose-spec/compose-go/v2/types"
+)
+
+// toolEnvVars are passed to docker-compose subprocesses even when host
+// variables are not allowed into the project, since the CLI needs them to
+// find and talk to the Docker daemon.
+var toolEnvVars = []string{
+	"PATH",
+	"HOME",
+	"USER",
+	"TMPDIR",
+	"DOCKER_HOST",
+	"DOCKER_CONFIG",
+	"DOCKER_CONTEXT",
+	"DOCKER_CERT_PATH",
+	"DOCKER_TLS_VERIFY",
+	"DOCKER_BUILDKIT",
+}
+
+// composeEnvironment is the set of variables a compose project is
+// interpolated with, and which of them were taken from the build host.
+type composeEnvironment struct {
+	values    map[string]string
+	host      map[string]bool
+	allowList bool
+
+	mu     sync.Mutex
+	lookup map[string]bool
+}
+
+// newComposeEnvironment builds the interpolation environment. Without an
+// environment allow-list every host variable is visible, as with a plain
+// docker-compose invocation; with one, only the listed host variables are.
+// Entries of the form NAME=value are literals and never touch the host. In
+// hermetic mode nothing is read from the host at all. Names in reserved are
+// never resolved at build time, so the device fills them in at runtime.
+func (n *Nix) newComposeEnvironment(dockerConfig *DockerComposeConfig, reserved []string) (*composeEnvironment, error) {
+	env := &composeEnvironment{
+		values:    make(map[string]string),
+		host:      make(map[string]bool),
+		allowList: dockerConfig.Environment != nil,
+		lookup:    make(map[string]bool),
+	}
+
+	if !n.Hermetic && !env.allowList {
+		for _, kv := range os.Environ() {
+			name, value, _ := strings.Cut(kv, "=")
+			env.values[name] = value
+			env.host[name] = true
+		}
+	}
+
+	for _, entry := range dockerConfig.Environment {
+		name, value, isLiteral := strings.Cut(entry, "=")
+		if name == "" {
+			return nil, fmt.Errorf("invalid docker_compose.environment entry %q", entry)
+		}
+		if isLiteral {
+			env.values[name] = value
+			delete(env.host, name)
+			continue
+		}
+		if n.Hermetic {
+			return nil, fmt.Errorf("docker_compose.environment allows host variable %s, but host variables are refused in hermetic mode", name)
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			env.values[name] = value
+			env.host[name] = true
+		}
+	}
+
+	for _, name := range reserved {
+		delete(env.values, name)
+		delete(env.host, name)
+	}
+
+	return env, nil
+}
+
+// list returns the environment in KEY=value form for cli.WithEnv.
+func (e *composeEnvironment) list() []string {
+	list := make([]string, 0, len(e.values))
+	for name, value := range e.values {
+		list = append(list, name+"="+value)
+	}
+	return list
+}
+
+// commandEnv returns the environment for docker-compose subprocesses, so
+// builds are interpolated with the same variables as the embedded project.
+func (e *composeEnvironment) commandEnv() []string {
+	env := e.list()
+	for _, name := range toolEnvVars {
+		if _, set := e.values[name]; set {
+			continue
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// trackLookups records every variable consulted during interpolation.
+func (e *composeEnvironment) trackLookups(options *loader.Options) {
+	if options.Interpolate == nil || options.Interpolate.LookupValue == nil {
+		return
+	}
+	lookupValue := options.Interpolate.LookupValue
+	options.Interpolate.LookupValue = func(key string) (string, bool) {
+		value, ok := lookupValue(key)
+		if ok {
+			e.mu.Lock()
+			e.lookup[key] = true
+			e.mu.Unlock()
+		}
+		return value, ok
+	}
+}
+
+// usedHostVars returns the host variables that ended up in the project,
+// either through interpolation or as pass-through service environment.
+func (e *composeEnvironment) usedHostVars(project *types.Project) []string {
+	used := make(map[string]bool)
+	for name := range e.lookup {
+		if e.host[name] {
+			used[name] = true
+		}
+	}
+	for _, service := range project.Services {
+		for name, value := range service.Environment {
+			if e.host[name] && value != nil && *value == e.values[name] {
+				used[name] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(used))
+	for name := range used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e *composeEnvironment) reportHostVars(project *types.Project) {
+	names := e.usedHostVars(project)
+	if len(names) == 0 {
+		return
+	}
+
+	if e.allowList {
+		fmt.Printf("      \033[36mUsing host variables: %s\033[0m\n", strings.Join(names, ", "))
+		return
+	}
+	fmt.Printf("      \033[33mWarning: the embedded compose file contains values from your environment: %s\033[0m\n", strings.Join(names, ", "))
+	fmt.Printf("      \033[33mList them under docker_compose.environment, or use --hermetic to refuse host variables\033[0m\n")
+}
@@ -1,9 +1,11 @@
 package nix
 
 import (
+	"cmp"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 
 	"gopkg.in/yaml.v3"
 )
@@ -11,24 +13,50 @@ import (
 // LoadConfig loads the sprout.yaml config and processes Docker images.
 // Use this when building images (seed command).
 func (n *Nix) LoadConfig(filename string) (*SproutFile, error) {
-	return n.loadConfig(filename, true)
+	return n.loadConfig(filename, loadOptions{processDocker: true})
 }
 
 // LoadConfigOnly loads the sprout.yaml config without processing Docker images.
 // Use this when you only need to read config values (like burn command reading output path).
 func (n *Nix) LoadConfigOnly(filename string) (*SproutFile, error) {
-	return n.loadConfig(filename, false)
+	return n.loadConfig(filename, loadOptions{})
 }
 
-func (n *Nix) loadConfig(filename string, processDocker bool) (*SproutFile, error) {
-	data, err := os.ReadFile(filename)
+// LoadSystemConfig loads the sprout.yaml config and processes the compose
+// stacks for building the NixOS system alone, with `sprout upgrade`. The
+// Docker data root is not built and secrets are not staged, as the system
+// does not contain them.
+func (n *Nix) LoadSystemConfig(filename string) (*SproutFile, error) {
+	return n.loadConfig(filename, loadOptions{processDocker: true, system: true})
+}
+
+// LoadDeployConfig loads the sprout.yaml config and processes the named
+// stacks, or all enabled stacks if none are given, for installing on a
+// running device with `sprout deploy`.
+func (n *Nix) LoadDeployConfig(filename string, stacks []string) (*SproutFile, error) {
+	return n.loadConfig(filename, loadOptions{processDocker: true, deploy: true, stacks: stacks})
+}
+
+type loadOptions struct {
+	processDocker bool
+	// deploy rewrites project files for the deployed stack directory
+	// instead of the image, and skips building a data root.
+	deploy bool
+	// stacks limits processing to the named stacks.
+	stacks []string
+	// system skips what only the image needs: the Docker data root and the
+	// secret values. Only the names of the secrets are read.
+	system bool
+}
+
+func (n *Nix) loadConfig(filename string, options loadOptions) (*SproutFile, error) {
+	root, device, err := n.configNode(filename)
 	if err != nil {
 		return nil, err
 	}
 
 	var sproutFile SproutFile
-	err = yaml.Unmarshal(data, &sproutFile)
-	if err != nil {
+	if err := root.Decode(&sproutFile); err != nil {
 		return nil, err
 	}
 
@@ -37,28 +65,148 @@ func (n *Nix) loadConfig(filename string, processDocker bool) (*SproutFile, erro
 		sproutFile.Username = "sprout"
 	}
 
-	shouldProcess := processDocker && sproutFile.DockerCompose.Enabled && sproutFile.DockerCompose.Path != ""
-	if !shouldProcess {
-		return &sproutFile, nil
+	if err := sproutFile.DockerCompose.normalize(); err != nil {
+		return nil, err
+	}
+	if err := sproutFile.Image.normalize(); err != nil {
+		return nil, err
+	}
+	if err := sproutFile.Test.normalize(); err != nil {
+		return nil, err
+	}
+	// The firmware, both slots and the data partition already use all four
+	// primary partitions, leaving none for a Docker data root
+	if sproutFile.Image.ABLayout() && sproutFile.UsesDataRoot() {
+		return nil, fmt.Errorf("docker_compose preload %q is not supported with image.layout %q", PreloadDataRoot, LayoutAB)
+	}
+	// Both want to be the partition that fills the rest of the card
+	if sproutFile.Image.ReadonlyRoot && sproutFile.UsesDataRoot() {
+		return nil, fmt.Errorf("docker_compose preload %q is not supported with image.readonly_root", PreloadDataRoot)
+	}
+
+	// A data root image is already its own Docker partition
+	if sproutFile.Image.DockerPartition && sproutFile.UsesDataRoot() {
+		return nil, fmt.Errorf("image.docker_partition is not needed with docker_compose preload %q", PreloadDataRoot)
+	}
+	if sproutFile.Image.DockerPartition && len(sproutFile.DockerCompose.Enabled()) == 0 {
+		return nil, fmt.Errorf("image.docker_partition needs docker_compose")
+	}
+	// Secrets are written into the built image with debugfs
+	if sproutFile.Secrets.File != "" && sproutFile.Image.RootFS != RootFSExt4 {
+		return nil, fmt.Errorf("secrets need image.root_fs %q, they are written into the root filesystem after the build", RootFSExt4)
 	}
 
 	configDir := filepath.Dir(filename)
-	dockerComposePath := sproutFile.DockerCompose.Path
-	if !filepath.IsAbs(dockerComposePath) {
-		dockerComposePath = filepath.Join(configDir, dockerComposePath)
+	if err := sproutFile.Wireless.normalize(configDir); err != nil {
+		return nil, err
+	}
+	// Devices share the top-level output path unless they set their own
+	if device != nil && mappingValue(mappingValue(device, "output"), "path") == nil {
+		sproutFile.Output.Path = deviceOutputPath(cmp.Or(sproutFile.Output.Path, DefaultOutputPath), n.Device)
+	}
+	sproutFile.Output.resolve(configDir)
+	// Devices are named after themselves unless they set a hostname
+	if device != nil && mappingValue(device, "hostname") == nil {
+		sproutFile.Hostname = n.Device
+	}
+	if sproutFile.Hostname == "" {
+		sproutFile.Hostname = DefaultHostname
 	}
 
-	dockerComposeData, err := os.ReadFile(dockerComposePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read docker-compose file at %s: %w", dockerComposePath, err)
+	for _, name := range options.stacks {
+		if stack, ok := sproutFile.DockerCompose.Stack(name); !ok || !stack.Enabled {
+			return nil, fmt.Errorf("no enabled docker_compose stack named %q", name)
+		}
 	}
 
-	sproutFile.DockerCompose.Content = string(dockerComposeData)
+	if options.processDocker && sproutFile.Secrets.File != "" {
+		if err := n.loadSecrets(&sproutFile, configDir, !options.system); err != nil {
+			return nil, fmt.Errorf("failed to load secrets: %w", err)
+		}
+	}
 
-	err = n.processDockerComposeImages(&sproutFile.DockerCompose, dockerComposePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to process docker-compose images: %w", err)
+	if !options.processDocker {
+		return &sproutFile, nil
+	}
+
+	saved := make(map[string]bool)
+	for i := range sproutFile.DockerCompose {
+		stack := &sproutFile.DockerCompose[i]
+		composeFiles := stack.ComposeFiles()
+		if !stack.Enabled || len(composeFiles) == 0 {
+			continue
+		}
+		if len(options.stacks) > 0 && !slices.Contains(options.stacks, stack.Name) {
+			continue
+		}
+		stack.deployed = options.deploy
+
+		if len(sproutFile.DockerCompose) > 1 {
+			fmt.Printf("      \033[36mStack: %s\033[0m\n", stack.Name)
+		}
+
+		composePaths := resolvePaths(configDir, composeFiles)
+		envFiles := resolvePaths(configDir, stack.EnvFiles)
+
+		dockerComposeData, err := os.ReadFile(composePaths[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read docker-compose file at %s: %w", composePaths[0], err)
+		}
+
+		stack.Content = string(dockerComposeData)
+
+		err = n.processDockerComposeImages(stack, &sproutFile.Secrets, configDir, composePaths, envFiles, saved)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process docker-compose images for stack %s: %w", stack.Name, err)
+		}
+
+		for _, img := range stack.Images {
+			if !containsImage(sproutFile.Images, img) {
+				sproutFile.Images = append(sproutFile.Images, img)
+			}
+		}
+	}
+
+	if !options.deploy && !options.system && sproutFile.DataRootPartition() {
+		if err := n.buildDockerDataRoot(&sproutFile); err != nil {
+			return nil, fmt.Errorf("failed to build docker data root: %w", err)
+		}
 	}
 
 	return &sproutFile, nil
 }
+
+// configNode reads a sprout.yaml into its top-level mapping, with the files
+// it extends, the overlays and the overrides of n.Device merged in. The
+// overrides are returned as well.
+func (n *Nix) configNode(filename string) (*yaml.Node, *yaml.Node, error) {
+	tree, err := n.readConfig(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n.Device == "" {
+		return tree.root, nil, nil
+	}
+	return tree.device(n.Device)
+}
+
+func containsImage(images []DockerImage, img DockerImage) bool {
+	for _, existing := range images {
+		if existing.LocalTag == img.LocalTag {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePaths makes relative paths absolute against baseDir.
+func resolvePaths(baseDir string, paths []string) []string {
+	resolved := make([]string, len(paths))
+	for i, path := range paths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		resolved[i] = path
+	}
+	return resolved
+}
@@ -0,0 +1,71 @@
+package nix
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/fcjr/sprout/internal/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// Devices are per-device overrides of the top-level settings, keyed by
+// device name. Mappings are merged into the top level, anything else
+// replaces it.
+type Devices map[string]yaml.Node
+
+var deviceNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Names returns the device names in order.
+func (d Devices) Names() []string {
+	names := make([]string, 0, len(d))
+	for name := range d {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// ExtendSchema leaves the overrides to be checked once merged, so that
+// devices can override part of a setting.
+func (Devices) ExtendSchema(s *schema.Schema, g *schema.Generator) error {
+	s.AdditionalProperties = &schema.Schema{
+		Type:        "object",
+		Description: "Settings of this device, merged into the top-level ones",
+	}
+	return nil
+}
+
+// device returns the top-level settings with the overrides of the named
+// device merged in and the devices section removed, along with the
+// overrides.
+func (t *configTree) device(name string) (*yaml.Node, *yaml.Node, error) {
+	devices := mappingValue(t.root, "devices")
+	device := mappingValue(devices, name)
+	if device == nil {
+		return nil, nil, fmt.Errorf("no device named %q in devices", name)
+	}
+	if device.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("device %q is not a mapping of settings", name)
+	}
+	if mappingValue(device, "devices") != nil {
+		return nil, nil, fmt.Errorf("device %q cannot have devices of its own", name)
+	}
+	top := withoutKey(t.root, "devices")
+	t.sources[top] = t.source(t.root)
+	// The tree is reused for other devices, so its markers stay in place
+	merged := t.merge(top, t.clone(device))
+	if err := t.clearMarkers(merged, false); err != nil {
+		return nil, nil, err
+	}
+	return merged, device, nil
+}
+
+// deviceOutputPath names the image of a device after the image of the
+// top-level configuration, e.g. build/image-kiosk1.img.
+func deviceOutputPath(path, device string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + device + ext
+}
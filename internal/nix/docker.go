@@ -3,28 +3,36 @@ package nix
 import (
 	"context"
 	"fmt"
-	"io"
-	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/compose-spec/compose-go/v2/cli"
 	"github.com/compose-spec/compose-go/v2/types"
-	"github.com/docker/docker/api/types/image"
-	"github.com/docker/docker/client"
 	"gopkg.in/yaml.v3"
 )
 
-func (n *Nix) processDockerComposeImages(dockerConfig *DockerComposeConfig, composePath string) error {
-	projectName := "sprout-embedded"
+// processDockerComposeImages resolves a stack's project, collects its images
+// and files and rewrites it for the device. Images already listed in saved
+// were embedded for an earlier stack and are not built or pulled again.
+func (n *Nix) processDockerComposeImages(dockerConfig *DockerComposeConfig, secrets *SecretsConfig, configDir string, composePaths, envFiles []string, saved map[string]bool) error {
+	projectName := "sprout-" + dockerConfig.Name
 	ctx := context.Background()
 
+	env, err := n.newComposeEnvironment(dockerConfig, secrets.Environment)
+	if err != nil {
+		return err
+	}
+
 	options, err := cli.NewProjectOptions(
-		[]string{composePath},
-		cli.WithOsEnv,
+		composePaths,
+		cli.WithEnv(env.list()),
+		cli.WithEnvFiles(envFiles...),
 		cli.WithDotEnv,
+		cli.WithProfiles(dockerConfig.Profiles),
+		cli.WithDiscardEnvFile,
 		cli.WithName(projectName),
+		cli.WithLoadOptions(env.trackLookups),
 	)
 	if err != nil {
 		return fmt.Errorf("failed to create project options: %w", err)
@@ -34,18 +42,22 @@ func (n *Nix) processDockerComposeImages(dockerConfig *DockerComposeConfig, comp
 	if err != nil {
 		return fmt.Errorf("failed to parse docker-compose file: %w", err)
 	}
+	env.reportHostVars(project)
+	dockerConfig.ProjectName = project.Name
+
+	// Tarballs are shared by the devices of a run, so pulled images are
+	// saved only once
+	stagingDir, err := n.stagingDir()
+	if err != nil {
+		return err
+	}
 
 	var images []DockerImage
 	imageMap := make(map[string]bool)
 
-	for _, service := range project.Services {
-		var imageName string
-
-		if service.Image != "" {
-			imageName = service.Image
-		} else if service.Build != nil {
-			imageName = fmt.Sprintf("%s:latest", service.Name)
-		}
+	for _, name := range project.ServiceNames() {
+		service := project.Services[name]
+		imageName := serviceImageName(project, service)
 
 		if imageName != "" && !imageMap[imageName] {
 			safeImageName := strings.ReplaceAll(imageName, "/", "_")
@@ -55,23 +67,38 @@ func (n *Nix) processDockerComposeImages(dockerConfig *DockerComposeConfig, comp
 			localTag := fmt.Sprintf("embedded/%s", safeImageName)
 			tarFileName := fmt.Sprintf("%s.tar", safeImageName)
 
-			images = append(images, DockerImage{
+			img := DockerImage{
 				Name:     imageName,
 				LocalTag: localTag,
-				TarPath:  fmt.Sprintf("/tmp/%s", tarFileName),
-			})
+				TarPath:  filepath.Join(stagingDir, tarFileName),
+			}
+			if service.Image == "" {
+				img.Service = service.Name
+			}
+			images = append(images, img)
 			imageMap[imageName] = true
 		}
 	}
 
 	dockerConfig.Images = images
+	dockerConfig.Services = composeServices(project)
+
+	err = n.collectComposeAssets(dockerConfig, secrets, project, configDir)
+	if err != nil {
+		return fmt.Errorf("failed to embed compose project files: %w", err)
+	}
 
 	err = n.createModifiedComposeContent(dockerConfig, project)
 	if err != nil {
 		return fmt.Errorf("failed to create modified compose content: %w", err)
 	}
 
-	err = n.buildAndSaveDockerImages(dockerConfig, filepath.Dir(composePath))
+	invocation := &ComposeInvocation{
+		WorkingDir: filepath.Dir(composePaths[0]),
+		Args:       composeCLIArgs(project.Name, composePaths, envFiles, dockerConfig.Profiles),
+		Env:        env.commandEnv(),
+	}
+	err = n.buildAndSaveDockerImages(dockerConfig, invocation, saved)
 	if err != nil {
 		return fmt.Errorf("failed to build and save docker images: %w", err)
 	}
@@ -79,6 +106,36 @@ func (n *Nix) processDockerComposeImages(dockerConfig *DockerComposeConfig, comp
 	return nil
 }
 
+// serviceImageName returns the image a service runs. Services that are only
+// built are named after the project, as docker-compose does, so identically
+// named services of different stacks do not collide.
+func serviceImageName(project *types.Project, service types.ServiceConfig) string {
+	if service.Image != "" {
+		return service.Image
+	}
+	if service.Build != nil {
+		return fmt.Sprintf("%s-%s:latest", project.Name, service.Name)
+	}
+	return ""
+}
+
+// composeServices lists the project's services in a stable order, keeping
+// only dependencies on services that are part of the project.
+func composeServices(project *types.Project) []ComposeService {
+	services := make([]ComposeService, 0, len(project.Services))
+	for _, name := range project.ServiceNames() {
+		service := ComposeService{Name: name}
+		for dependency := range project.Services[name].DependsOn {
+			if _, ok := project.Services[dependency]; ok {
+				service.DependsOn = append(service.DependsOn, dependency)
+			}
+		}
+		sort.Strings(service.DependsOn)
+		services = append(services, service)
+	}
+	return services
+}
+
 func (n *Nix) createModifiedComposeContent(dockerConfig *DockerComposeConfig, project *types.Project) error {
 	imageMapping := make(map[string]string)
 	for _, img := range dockerConfig.Images {
@@ -86,10 +143,10 @@ func (n *Nix) createModifiedComposeContent(dockerConfig *DockerComposeConfig, pr
 	}
 
 	for serviceName, service := range project.Services {
-		if service.Image != "" && imageMapping[service.Image] != "" {
-			service.Image = imageMapping[service.Image]
-		} else if service.Build != nil {
-			localTag := fmt.Sprintf("embedded/%s_latest", serviceName)
+		// Services outside the selected profiles were already dropped by the
+		// loader; clear the rest so the device starts them without --profile.
+		service.Profiles = nil
+		if localTag := imageMapping[serviceImageName(project, service)]; localTag != "" {
 			service.Image = localTag
 			service.Build = nil
 		}
@@ -105,104 +162,71 @@ func (n *Nix) createModifiedComposeContent(dockerConfig *DockerComposeConfig, pr
 	return nil
 }
 
-func (n *Nix) buildAndSaveDockerImages(dockerConfig *DockerComposeConfig, workingDir string) error {
-	fmt.Printf("      \033[36mBuilding and saving Docker images...\033[0m\n")
+// ComposeInvocation describes how to run docker-compose against the same
+// project that was loaded for embedding.
+type ComposeInvocation struct {
+	WorkingDir string
+	Args       []string
+	Env        []string
+}
 
-	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		return fmt.Errorf("failed to create Docker client: %w", err)
+// composeCLIArgs returns the docker-compose global flags that select the
+// same project name, files, env files and profiles the project was loaded
+// with.
+func composeCLIArgs(projectName string, composePaths, envFiles, profiles []string) []string {
+	args := []string{"-p", projectName}
+	for _, path := range composePaths {
+		args = append(args, "-f", path)
+	}
+	for _, envFile := range envFiles {
+		args = append(args, "--env-file", envFile)
+	}
+	for _, profile := range profiles {
+		args = append(args, "--profile", profile)
 	}
-	defer cli.Close()
+	return args
+}
+
+func (n *Nix) buildAndSaveDockerImages(dockerConfig *DockerComposeConfig, invocation *ComposeInvocation, saved map[string]bool) error {
+	fmt.Printf("      \033[36mBuilding and saving Docker images...\033[0m\n")
 
+	ctx := context.Background()
+	fetcher := n.fetcher()
 	for i, img := range dockerConfig.Images {
+		if saved[img.LocalTag] {
+			fmt.Printf("      \033[36mAlready embedded: %s\033[0m\n", img.Name)
+			continue
+		}
+		// Built images can differ between devices, pulled ones cannot
+		if img.Service == "" && n.pulled[img.Name] {
+			fmt.Printf("      \033[36mAlready saved: %s\033[0m\n", img.Name)
+			saved[img.LocalTag] = true
+			continue
+		}
 		fmt.Printf("      \033[36mProcessing: %s\033[0m\n", img.Name)
 
-		if err := n.buildOrPullImage(ctx, cli, &img, workingDir); err != nil {
+		if img.Service != "" {
+			if err := fetcher.Build(img.Service, invocation); err != nil {
+				return err
+			}
+		} else if err := fetcher.Pull(ctx, img.Name); err != nil {
 			return err
 		}
 
-		if err := n.tagAndSaveImage(ctx, cli, &img); err != nil {
+		if err := fetcher.Save(ctx, img); err != nil {
 			return err
 		}
 
 		fmt.Printf("      \033[32mSaved: %s\033[0m\n", img.LocalTag)
 		dockerConfig.Images[i] = img
+		saved[img.LocalTag] = true
+		if img.Service == "" {
+			if n.pulled == nil {
+				n.pulled = make(map[string]bool)
+			}
+			n.pulled[img.Name] = true
+		}
 	}
 
 	return nil
 }
-
-func (n *Nix) buildOrPullImage(ctx context.Context, cli *client.Client, img *DockerImage, workingDir string) error {
-	if strings.HasSuffix(img.Name, ":latest") && !strings.Contains(img.Name, "/") {
-		return n.buildLocalImage(img.Name, workingDir)
-	}
-	return n.pullImage(ctx, cli, img.Name)
-}
-
-func (n *Nix) buildLocalImage(imageName, workingDir string) error {
-	serviceName := strings.TrimSuffix(imageName, ":latest")
-	cmd := exec.Command("docker-compose", "build", serviceName)
-	cmd.Dir = workingDir
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to build service %s: %w", serviceName, err)
-	}
-	return nil
-}
-
-func (n *Nix) pullImage(ctx context.Context, cli *client.Client, imageName string) error {
-	pullOptions := image.PullOptions{
-		Platform: "linux/arm64",
-	}
-	reader, err := cli.ImagePull(ctx, imageName, pullOptions)
-	if err != nil {
-		return n.pullDefaultImage(ctx, cli, imageName)
-	}
-
-	fmt.Printf("      Successfully pulled ARM64 image: %s\n", imageName)
-	io.Copy(io.Discard, reader)
-	reader.Close()
-	return nil
-}
-
-func (n *Nix) pullDefaultImage(ctx context.Context, cli *client.Client, imageName string) error {
-	fmt.Printf("      ARM64 image not available, trying default platform: %s\n", imageName)
-	pullOptions := image.PullOptions{}
-	reader, err := cli.ImagePull(ctx, imageName, pullOptions)
-	if err != nil {
-		fmt.Printf("Warning: failed to pull image %s, assuming it exists locally: %v\n", imageName, err)
-		return nil
-	}
-	io.Copy(io.Discard, reader)
-	reader.Close()
-	return nil
-}
-
-func (n *Nix) tagAndSaveImage(ctx context.Context, cli *client.Client, img *DockerImage) error {
-	err := cli.ImageTag(ctx, img.Name, img.LocalTag)
-	if err != nil {
-		return fmt.Errorf("failed to tag image %s as %s: %w", img.Name, img.LocalTag, err)
-	}
-
-	reader, err := cli.ImageSave(ctx, []string{img.LocalTag})
-	if err != nil {
-		return fmt.Errorf("failed to save image %s: %w", img.LocalTag, err)
-	}
-	defer reader.Close()
-
-	return n.saveImageToFile(reader, img.TarPath)
-}
-
-func (n *Nix) saveImageToFile(reader io.ReadCloser, tarPath string) error {
-	tarFile, err := os.Create(tarPath)
-	if err != nil {
-		return fmt.Errorf("failed to create tar file %s: %w", tarPath, err)
-	}
-	defer tarFile.Close()
-
-	_, err = io.Copy(tarFile, reader)
-	if err != nil {
-		return fmt.Errorf("failed to write image to tar file %s: %w", tarPath, err)
-	}
-	return nil
-}
@@ -0,0 +1,67 @@
+package nix
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	configpkg "github.com/fcjr/sprout/internal/config"
+)
+
+// BuildQEMUFirmware returns U-Boot for the QEMU arm64 virt machine. It boots
+// Sprout images from their extlinux configuration just like U-Boot on the
+// Pi. The firmware is built once and kept in the config folder.
+func (n *Nix) BuildQEMUFirmware() (string, error) {
+	configFolder, err := configpkg.Folder()
+	if err != nil {
+		return "", fmt.Errorf("failed to get config folder: %w", err)
+	}
+	firmwarePath := filepath.Join(configFolder, "qemu", "u-boot-aarch64.bin")
+	if _, err := os.Stat(firmwarePath); err == nil {
+		return firmwarePath, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(firmwarePath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create firmware directory: %w", err)
+	}
+
+	isDisabled := os.Getenv("SPROUT_DISABLE_LOCAL_NIX") != ""
+	nixPath, hasNix := exec.LookPath("nix-build")
+	if !isDisabled && hasNix == nil {
+		cmd := exec.Command(nixPath, "<nixpkgs>", "--argstr", "system", "aarch64-linux", "-A", "ubootQemuAarch64", "--no-link")
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to build U-Boot: %w", err)
+		}
+		storePath, err := n.extractNixStorePath(string(output))
+		if err != nil {
+			return "", err
+		}
+		if err := n.copyFile(filepath.Join(storePath, "u-boot.bin"), firmwarePath); err != nil {
+			return "", fmt.Errorf("failed to copy U-Boot: %w", err)
+		}
+		return firmwarePath, nil
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	tempDir, err := os.MkdirTemp(homeDir, "sprout-docker-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	script := `set -e
+out=$(nix-build '<nixpkgs>' --argstr system aarch64-linux -A ubootQemuAarch64 --no-link)
+cp "$out/u-boot.bin" /workspace/u-boot.bin`
+	if _, err := n.runBuilderScript(tempDir, script); err != nil {
+		return "", fmt.Errorf("failed to build U-Boot: %w", err)
+	}
+	if err := n.copyFile(filepath.Join(tempDir, "u-boot.bin"), firmwarePath); err != nil {
+		return "", fmt.Errorf("failed to copy U-Boot: %w", err)
+	}
+	return firmwarePath, nil
+}
@@ -0,0 +1,152 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Value sources replace a value with one read at load time.
+const (
+	// fileTag reads the value from a file, relative to the file the value
+	// is written in.
+	fileTag = "!file"
+	// envTag reads the value from an environment variable.
+	envTag = "!env"
+	// cmdTag runs a shell command in the directory of the file the value is
+	// written in and uses its output.
+	cmdTag = "!cmd"
+)
+
+var (
+	// variablePattern matches $$ and ${...} references.
+	variablePattern = regexp.MustCompile(`\$\$|\$\{[^}]*\}?`)
+	// referencePattern is the inside of a reference: a name and optionally
+	// :-default, used when the variable is unset or empty, or -default,
+	// used when it is unset.
+	referencePattern = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)(?:(:?-)(.*))?\}$`)
+)
+
+// interpolate replaces the variable references and value sources of the
+// scalars under node. !file and !cmd are relative to the file each value
+// came from, so an extended file can use paths of its own.
+func (t *configTree) interpolate(node *yaml.Node) error {
+	for _, child := range node.Content {
+		if err := t.interpolate(child); err != nil {
+			return err
+		}
+	}
+	if node.Kind != yaml.ScalarNode {
+		switch node.Tag {
+		case fileTag, envTag, cmdTag:
+			return &configError{File: t.source(node), Node: node, Err: fmt.Errorf("%s can only be used on single values", node.Tag)}
+		}
+		return nil
+	}
+	if _, done := t.origins[node]; done {
+		return nil
+	}
+
+	var value string
+	var err error
+	switch node.Tag {
+	case fileTag, envTag, cmdTag:
+		value, err = readSource(node.Tag, node.Value, filepath.Dir(t.source(node)))
+		if err == nil {
+			original := *node
+			t.origins[node] = &original
+			// Sources are always strings, whatever they look like
+			node.Tag, node.Style, node.Value = "!!str", node.Style&^yaml.TaggedStyle, value
+		}
+	default:
+		if !strings.Contains(node.Value, "$") {
+			return nil
+		}
+		value, err = expandVariables(node.Value)
+		if err == nil && value != node.Value {
+			original := *node
+			t.origins[node] = &original
+			node.Value = value
+			// Unquoted values are typed by what they expand to
+			if node.Style == 0 && node.Tag == "!!str" {
+				node.Tag = ""
+			}
+		}
+	}
+	if err != nil {
+		return &configError{File: t.source(node), Node: node, Err: err}
+	}
+	return nil
+}
+
+// expandVariables replaces ${NAME}, ${NAME:-default} and ${NAME-default}
+// with the values of environment variables, and $$ with $.
+func expandVariables(s string) (string, error) {
+	var expandErr error
+	expanded := variablePattern.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		m := referencePattern.FindStringSubmatch(match)
+		if m == nil {
+			if expandErr == nil {
+				expandErr = fmt.Errorf("invalid variable reference %s; write $$ for a literal $", match)
+			}
+			return match
+		}
+		name, operator, fallback := m[1], m[2], m[3]
+		value, set := os.LookupEnv(name)
+		switch {
+		case operator == ":-" && value == "":
+			return fallback
+		case operator == "-" && !set:
+			return fallback
+		case !set:
+			if expandErr == nil {
+				expandErr = fmt.Errorf("variable %s is not set; give a default with ${%s:-default}", name, name)
+			}
+		}
+		return value
+	})
+	return expanded, expandErr
+}
+
+// readSource returns the value of a !file, !env or !cmd source. dir is what
+// !file and !cmd are relative to.
+func readSource(tag, arg, dir string) (string, error) {
+	arg = strings.TrimSpace(arg)
+	switch tag {
+	case fileTag:
+		path := resolvePaths(dir, []string{arg})[0]
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%s %s: %w", fileTag, arg, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case envTag:
+		value, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("%s %s: variable %s is not set", envTag, arg, arg)
+		}
+		return value, nil
+	default:
+		cmd := exec.Command("sh", "-c", arg)
+		cmd.Dir = dir
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			if message := strings.TrimSpace(stderr.String()); message != "" {
+				return "", fmt.Errorf("%s %s: %w: %s", cmdTag, arg, err, message)
+			}
+			return "", fmt.Errorf("%s %s: %w", cmdTag, arg, err)
+		}
+		return strings.TrimRight(string(output), "\r\n"), nil
+	}
+}
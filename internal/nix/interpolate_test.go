@@ -0,0 +1,37 @@
+package nix
+
+import "testing"
+
+func TestExpandVariables(t *testing.T) {
+	t.Setenv("SET", "value")
+	t.Setenv("EMPTY", "")
+
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "${SET}", want: "value"},
+		{in: "a-${SET}-b", want: "a-value-b"},
+		{in: "${UNSET:-fallback}", want: "fallback"},
+		{in: "${EMPTY:-fallback}", want: "fallback"},
+		{in: "${EMPTY-fallback}", want: ""},
+		{in: "${UNSET-fallback}", want: "fallback"},
+		{in: "${UNSET:-}", want: ""},
+		{in: "$$SET and $${SET}", want: "$SET and ${SET}"},
+		{in: "cost: $5", want: "cost: $5"},
+		{in: "${UNSET}", wantErr: true},
+		{in: "${SET", wantErr: true},
+		{in: "${1BAD}", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := expandVariables(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("expandVariables(%q) error = %v, want error %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("expandVariables(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package nix
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// defaultRootSize is the size of the root partition in MiB when
+	// partitions are added behind it, and of each slot of an A/B layout.
+	defaultRootSize = 4096
+	// minRootSize leaves room for a NixOS system with Docker.
+	minRootSize = 1024
+	// minFirmwareSize fits the Raspberry Pi firmware and U-Boot.
+	minFirmwareSize = 30
+	// defaultKernelFirmwareSize and minKernelFirmwareSize are used when the
+	// kernels are booted from the firmware partition.
+	defaultKernelFirmwareSize = 256
+	minKernelFirmwareSize     = 128
+	// minDockerSize leaves room for a few container images.
+	minDockerSize = 1024
+	// fillReserve is how much room a partition that fills the rest of the
+	// card needs at least, in MiB.
+	fillReserve = 512
+	// defaultBootAttempts is how often a new root slot may fail to boot
+	// before the device falls back to the previous one.
+	defaultBootAttempts = 3
+)
+
+// normalize fills in defaults and checks the partition layout settings.
+func (c *ImageConfig) normalize() error {
+	switch c.Layout {
+	case "":
+		c.Layout = LayoutSingle
+	case LayoutSingle, LayoutAB:
+	default:
+		return fmt.Errorf("invalid image.layout %q: expected %q or %q", c.Layout, LayoutSingle, LayoutAB)
+	}
+
+	switch c.RootFS {
+	case "":
+		c.RootFS = RootFSExt4
+	case RootFSExt4, RootFSBtrfs, RootFSF2FS:
+	default:
+		return fmt.Errorf("invalid image.root_fs %q: expected %q, %q or %q", c.RootFS, RootFSExt4, RootFSBtrfs, RootFSF2FS)
+	}
+	// Slots are installed and relabelled as ext4 filesystems
+	if c.RootFS != RootFSExt4 && c.ABLayout() {
+		return fmt.Errorf("image.root_fs %q is not supported with image.layout %q", c.RootFS, LayoutAB)
+	}
+	// A read-only root gains nothing from a flash-friendly filesystem
+	if c.RootFS != RootFSExt4 && c.ReadonlyRoot {
+		return fmt.Errorf("image.root_fs %q is not supported with image.readonly_root", c.RootFS)
+	}
+
+	if c.FirmwareSize == 0 && c.KernelsOnFirmware() {
+		c.FirmwareSize = defaultKernelFirmwareSize
+	}
+	if c.FirmwareSize != 0 && c.FirmwareSize < minFirmwareSize {
+		return fmt.Errorf("image.firmware_size must be at least %d MiB", minFirmwareSize)
+	}
+	if c.KernelsOnFirmware() && c.FirmwareSize < minKernelFirmwareSize {
+		return fmt.Errorf("image.firmware_size must be at least %d MiB with image.root_fs %q, as it holds the kernels", minKernelFirmwareSize, c.RootFS)
+	}
+
+	if c.DockerPartition && c.ABLayout() {
+		return fmt.Errorf("image.docker_partition is not supported with image.layout %q", LayoutAB)
+	}
+	if c.DockerSize != 0 && !c.DockerPartition {
+		return fmt.Errorf("image.docker_size needs image.docker_partition")
+	}
+	// The data partition fills the rest of the card
+	if c.DockerPartition && c.ReadonlyRoot && c.DockerSize == 0 {
+		return fmt.Errorf("image.docker_partition needs image.docker_size with image.readonly_root")
+	}
+	if c.DockerSize != 0 && c.DockerSize < minDockerSize {
+		return fmt.Errorf("image.docker_size must be at least %d MiB", minDockerSize)
+	}
+
+	// A read-only root keeps the size it was built with
+	if c.RootSize == 0 && !c.ReadonlyRoot && len(c.AddedPartitions()) > 0 {
+		c.RootSize = defaultRootSize
+	}
+	if c.RootSize == 0 && c.ABLayout() {
+		c.RootSize = defaultRootSize
+	}
+	if c.RootSize != 0 && c.RootSize < minRootSize {
+		return fmt.Errorf("image.root_size must be at least %d MiB", minRootSize)
+	}
+	// f2fs cannot be grown while mounted, so it is built at its final size
+	if c.RootFS == RootFSF2FS && c.RootSize == 0 {
+		return fmt.Errorf("image.root_fs %q needs image.root_size", RootFSF2FS)
+	}
+
+	if c.BootAttempts == 0 {
+		c.BootAttempts = defaultBootAttempts
+	}
+	if c.BootAttempts < 1 {
+		return fmt.Errorf("image.boot_attempts must be at least 1")
+	}
+
+	for i, p := range c.Persist {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("image.persist path %q must be absolute", p)
+		}
+		p = path.Clean(p)
+		if p == "/" || withinDir(p, "/nix") || withinDir(p, "/persist") || withinDir(p, readonlyRootMount) {
+			return fmt.Errorf("image.persist path %q cannot be persisted", c.Persist[i])
+		}
+		c.Persist[i] = p
+	}
+	if len(c.Persist) > 0 && !c.HasDataPartition() {
+		return fmt.Errorf("image.persist needs a data partition: set image.readonly_root or image.layout %q", LayoutAB)
+	}
+
+	return nil
+}
+
+// RequiredSize returns how large a card has to be, in bytes, for the built
+// image at imagePath and the partitions added to it on first boot.
+func (c ImageConfig) RequiredSize(imagePath string) (int64, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open image: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get image file info: %w", err)
+	}
+	size := info.Size()
+	if !c.CustomLayout() {
+		return size, nil
+	}
+
+	mbr := make([]byte, 512)
+	if _, err := io.ReadFull(file, mbr); err != nil {
+		return 0, fmt.Errorf("failed to read the image partition table: %w", err)
+	}
+	if binary.LittleEndian.Uint16(mbr[510:]) != 0xaa55 {
+		return 0, errors.New("no DOS partition table found in the image")
+	}
+	// The root is the second partition
+	rootStart := int64(binary.LittleEndian.Uint32(mbr[446+16+8:])) * 512
+	size = max(size, rootStart+int64(c.RootSize)<<20)
+
+	for _, partition := range c.AddedPartitions() {
+		if partition.Size == 0 {
+			size += fillReserve << 20
+		} else {
+			size += int64(partition.Size) << 20
+		}
+	}
+	return size, nil
+}
+
+// withinDir reports whether p is dir or inside it.
+func withinDir(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
@@ -0,0 +1,356 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/fcjr/sprout/internal/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// Merge markers change how a value is merged into the one it overrides.
+const (
+	// appendTag appends a list to the list it overrides.
+	appendTag = "!append"
+	// replaceTag replaces a mapping instead of merging into it.
+	replaceTag = "!replace"
+)
+
+// Extends are the files a sprout.yaml builds on, relative to it. They are
+// merged in order, and the file itself last.
+type Extends []string
+
+func (e *Extends) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*e = Extends{node.Value}
+		return nil
+	}
+	var files []string
+	if err := node.Decode(&files); err != nil {
+		return err
+	}
+	*e = files
+	return nil
+}
+
+// ExtendSchema accepts a single file or a list of files.
+func (Extends) ExtendSchema(s *schema.Schema, g *schema.Generator) error {
+	list := *s
+	*s = schema.Schema{OneOf: []*schema.Schema{{Type: "string"}, &list}}
+	return nil
+}
+
+// configError is a problem with one of the files a configuration is read
+// from. Node is nil for problems of the whole file.
+type configError struct {
+	File string
+	Node *yaml.Node
+	Err  error
+}
+
+func (e *configError) Error() string {
+	if e.Node != nil {
+		return fmt.Sprintf("%s:%d:%d: %v", e.File, e.Node.Line, e.Node.Column, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.File, e.Err)
+}
+
+func (e *configError) Unwrap() error {
+	return e.Err
+}
+
+// configTree is a sprout.yaml with the files it extends and the overlays
+// merged in. Merged nodes keep the positions of the file they were read
+// from, which sources records.
+type configTree struct {
+	root    *yaml.Node
+	sources map[*yaml.Node]string
+	// origins are scalars as written, before interpolation.
+	origins map[*yaml.Node]*yaml.Node
+}
+
+// readConfig reads filename, the files it extends and n.Overlays, without
+// applying a device, and interpolates the result. The tree is kept, so
+// commands in the configuration run once however often it is loaded.
+func (n *Nix) readConfig(filename string) (*configTree, error) {
+	key := strings.Join(append([]string{filename}, n.Overlays...), "\n")
+	if t := n.trees[key]; t != nil {
+		return t, nil
+	}
+
+	t := &configTree{sources: make(map[*yaml.Node]string), origins: make(map[*yaml.Node]*yaml.Node)}
+	root, err := t.read(filename, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, overlay := range n.Overlays {
+		layer, err := t.read(overlay, nil)
+		if err != nil {
+			return nil, err
+		}
+		root = t.merge(root, layer)
+	}
+	t.root = root
+	if err := t.clearMarkers(root, true); err != nil {
+		return nil, err
+	}
+	if err := t.interpolate(root); err != nil {
+		return nil, err
+	}
+	if n.trees == nil {
+		n.trees = make(map[string]*configTree)
+	}
+	n.trees[key] = t
+	return t, nil
+}
+
+// read parses a file and merges it over the files it extends. chain holds
+// the files being read, to find files that extend themselves.
+func (t *configTree) read(filename string, chain []string) (*yaml.Node, error) {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(chain, filename) {
+		return nil, &configError{File: filename, Err: fmt.Errorf("extends itself")}
+	}
+	chain = append(chain, filename)
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, &configError{File: filename, Err: err}
+	}
+	root := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if len(document.Content) > 0 {
+		root = document.Content[0]
+	}
+	t.record(root, filename)
+
+	extendsNode := mappingValue(root, "extends")
+	if extendsNode == nil {
+		return root, nil
+	}
+	var extends Extends
+	if err := extendsNode.Decode(&extends); err != nil {
+		return nil, &configError{File: filename, Node: extendsNode, Err: fmt.Errorf("extends must be a file or a list of files")}
+	}
+
+	var base *yaml.Node
+	for _, file := range extends {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(filename), file)
+		}
+		layer, err := t.read(file, chain)
+		if os.IsNotExist(err) {
+			return nil, &configError{File: filename, Node: extendsNode, Err: fmt.Errorf("extended file %s does not exist", file)}
+		}
+		if err != nil {
+			return nil, err
+		}
+		base = t.merge(base, layer)
+	}
+	root = withoutKey(root, "extends")
+	t.sources[root] = filename
+	return t.merge(base, root), nil
+}
+
+// record notes that node and everything below it came from file.
+func (t *configTree) record(node *yaml.Node, file string) {
+	t.sources[node] = file
+	for _, child := range node.Content {
+		t.record(child, file)
+	}
+}
+
+// clone returns a deep copy of node with the same sources and origins, so
+// markers can be cleared on it without changing the tree.
+func (t *configTree) clone(node *yaml.Node) *yaml.Node {
+	copied := *node
+	t.sources[&copied] = t.sources[node]
+	if origin := t.origins[node]; origin != nil {
+		t.origins[&copied] = origin
+	}
+	copied.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		copied.Content[i] = t.clone(child)
+	}
+	return &copied
+}
+
+// source returns the file node came from.
+func (t *configTree) source(node *yaml.Node) string {
+	if t == nil {
+		return ""
+	}
+	return t.sources[node]
+}
+
+// merge returns base with override merged in: mappings are merged key by
+// key, lists tagged !append are appended to and anything else is replaced,
+// as are mappings tagged !replace. Neither node is modified.
+func (t *configTree) merge(base, override *yaml.Node) *yaml.Node {
+	base, override = resolveAlias(base), resolveAlias(override)
+	if base == nil {
+		return override
+	}
+
+	switch {
+	case override.Kind == yaml.SequenceNode && override.Tag == appendTag && base.Kind == yaml.SequenceNode:
+		merged := *override
+		merged.Content = append(append([]*yaml.Node(nil), base.Content...), override.Content...)
+		t.sources[&merged] = t.sources[override]
+		return &merged
+	case override.Kind != yaml.MappingNode || base.Kind != yaml.MappingNode || override.Tag == replaceTag:
+		return override
+	}
+
+	merged := *base
+	merged.Content = append([]*yaml.Node(nil), base.Content...)
+	t.sources[&merged] = t.sources[base]
+	for i := 0; i+1 < len(override.Content); i += 2 {
+		key, value := override.Content[i], override.Content[i+1]
+		if j := mappingIndex(&merged, key.Value); j >= 0 {
+			merged.Content[j+1] = t.merge(merged.Content[j+1], value)
+		} else {
+			merged.Content = append(merged.Content, key, value)
+		}
+	}
+	return &merged
+}
+
+// clearMarkers checks where merge markers are used and drops them, so that
+// the merged tree decodes. At the top level, markers under devices are kept
+// until the device is merged.
+func (t *configTree) clearMarkers(node *yaml.Node, top bool) error {
+	switch node.Tag {
+	case appendTag:
+		if node.Kind != yaml.SequenceNode {
+			return &configError{File: t.source(node), Node: node, Err: fmt.Errorf("%s can only be used on lists", appendTag)}
+		}
+		node.Tag, node.Style = "!!seq", node.Style&^yaml.TaggedStyle
+	case replaceTag:
+		if node.Kind != yaml.MappingNode {
+			return &configError{File: t.source(node), Node: node, Err: fmt.Errorf("%s can only be used on mappings; other values are always replaced", replaceTag)}
+		}
+		node.Tag, node.Style = "!!map", node.Style&^yaml.TaggedStyle
+	}
+	for i, child := range node.Content {
+		if top && i%2 == 1 && node.Content[i-1].Value == "devices" {
+			continue
+		}
+		if err := t.clearMarkers(child, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mappingIndex returns the index of key's key node in a mapping, or -1.
+func mappingIndex(node *yaml.Node, key string) int {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// mappingValue returns the value of key in a mapping, or nil.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	node = resolveAlias(node)
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	if i := mappingIndex(node, key); i >= 0 {
+		return resolveAlias(node.Content[i+1])
+	}
+	return nil
+}
+
+// withoutKey returns a copy of a mapping without key.
+func withoutKey(node *yaml.Node, key string) *yaml.Node {
+	i := mappingIndex(node, key)
+	if i < 0 {
+		return node
+	}
+	copied := *node
+	copied.Content = append(append([]*yaml.Node(nil), node.Content[:i]...), node.Content[i+2:]...)
+	return &copied
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+// EffectiveConfig returns the configuration as it is built, with the files
+// it extends, the overlays and the device merged in. Every value is
+// commented with the file and line it came from.
+func (n *Nix) EffectiveConfig(filename string) ([]byte, error) {
+	tree, err := n.readConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	root := tree.root
+	if n.Device != "" {
+		if root, _, err = tree.device(n.Device); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(tree.annotate(root, filepath.Dir(filename))); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// annotate copies node with aliases expanded and the comments of the files
+// replaced by the place each value came from, relative to dir. Values read
+// from sources are shown as written, so secrets are not printed.
+func (t *configTree) annotate(node *yaml.Node, dir string) *yaml.Node {
+	source := resolveAlias(node)
+	copied := *source
+	copied.Anchor, copied.HeadComment, copied.LineComment, copied.FootComment = "", "", "", ""
+	// Flow style has no room for a comment per value
+	copied.Style &^= yaml.FlowStyle
+	copied.Content = make([]*yaml.Node, len(source.Content))
+	for i, child := range source.Content {
+		copied.Content[i] = t.annotate(child, dir)
+		if source.Kind == yaml.MappingNode && i%2 == 0 {
+			// Keys are not annotated
+			copied.Content[i].LineComment = ""
+		}
+	}
+
+	if file := t.source(source); file != "" && (copied.Kind == yaml.ScalarNode || len(copied.Content) == 0) {
+		if rel, err := filepath.Rel(dir, file); err == nil {
+			file = rel
+		}
+		copied.LineComment = fmt.Sprintf("%s:%d", file, source.Line)
+	}
+	if origin := t.origins[source]; origin != nil {
+		switch origin.Tag {
+		case fileTag, envTag, cmdTag:
+			copied.Tag, copied.Style, copied.Value = origin.Tag, origin.Style, origin.Value
+		default:
+			copied.LineComment += " " + origin.Value
+		}
+	}
+	return &copied
+}
@@ -0,0 +1,187 @@
+package nix
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     string
+		override string
+		want     string
+	}{
+		{
+			name:     "mappings merge",
+			base:     "a: 1\nb: {c: 2, d: 3}",
+			override: "b: {d: 4}\ne: 5",
+			want:     "a: 1\nb: {c: 2, d: 4}\ne: 5",
+		},
+		{
+			name:     "lists replace",
+			base:     "a: [1, 2]",
+			override: "a: [3]",
+			want:     "a: [3]",
+		},
+		{
+			name:     "append",
+			base:     "a: [1, 2]",
+			override: "a: !append [3]",
+			want:     "a: [1, 2, 3]",
+		},
+		{
+			name:     "append without a base",
+			base:     "b: 1",
+			override: "a: !append [3]",
+			want:     "b: 1\na: [3]",
+		},
+		{
+			name:     "replace",
+			base:     "a: {b: 1, c: 2}",
+			override: "a: !replace {c: 3}",
+			want:     "a: {c: 3}",
+		},
+		{
+			name:     "scalars replace mappings",
+			base:     "a: {b: 1}",
+			override: "a: null",
+			want:     "a: null",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			base := filepath.Join(dir, "base.yaml")
+			override := filepath.Join(dir, "sprout.yaml")
+			writeFile(t, base, tt.base)
+			writeFile(t, override, "extends: base.yaml\n"+tt.override)
+
+			tree, err := (&Nix{}).readConfig(override)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want any
+			if err := tree.root.Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if err := yaml.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			gotYAML, _ := yaml.Marshal(got)
+			wantYAML, _ := yaml.Marshal(want)
+			if string(gotYAML) != string(wantYAML) {
+				t.Errorf("got\n%s\nwant\n%s", gotYAML, wantYAML)
+			}
+		})
+	}
+}
+
+func TestMergeOrder(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "base.yaml"), "username: base\nautodiscovery: true")
+	writeFile(t, filepath.Join(dir, "sprout.yaml"), "extends: base.yaml\nusername: file\ndevices:\n  kiosk:\n    username: device")
+	writeFile(t, filepath.Join(dir, "overlay.yaml"), "username: overlay")
+
+	n := &Nix{Overlays: []string{filepath.Join(dir, "overlay.yaml")}}
+	config, err := n.LoadConfigOnly(filepath.Join(dir, "sprout.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Username != "overlay" || !config.Autodiscovery {
+		t.Errorf("got username %q and autodiscovery %t, want the overlay's username and the base's autodiscovery", config.Username, config.Autodiscovery)
+	}
+
+	n.Device = "kiosk"
+	config, err = n.LoadConfigOnly(filepath.Join(dir, "sprout.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Username != "device" {
+		t.Errorf("got username %q, want the device's", config.Username)
+	}
+	if want := filepath.Join(dir, "build", "image-kiosk.img"); config.Output.Path != want {
+		t.Errorf("got output path %s, want %s", config.Output.Path, want)
+	}
+
+	shown, err := n.EffectiveConfig(filepath.Join(dir, "sprout.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"username: device # sprout.yaml:5", "autodiscovery: true # base.yaml:2"} {
+		if !strings.Contains(string(shown), line) {
+			t.Errorf("config show is missing %q:\n%s", line, shown)
+		}
+	}
+}
+
+func TestSourcesRelativeToTheirFile(t *testing.T) {
+	dir := t.TempDir()
+	common, site := filepath.Join(dir, "common"), filepath.Join(dir, "site")
+	for _, d := range []string{filepath.Join(common, "keys"), site} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(common, "keys", "admin.pub"), validKey)
+	writeFile(t, filepath.Join(common, "base.yaml"), "ssh_keys:\n  - !file keys/admin.pub\nusername: !cmd echo run >> runs && echo admin")
+	writeFile(t, filepath.Join(site, "name"), "lobby")
+	writeFile(t, filepath.Join(site, "sprout.yaml"), "extends: ../common/base.yaml\nhostname: !cmd cat name\ndevices:\n  kiosk:\n    username: kiosk")
+
+	n := &Nix{}
+	filename := filepath.Join(site, "sprout.yaml")
+	if err := n.Validate(filename); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	config, err := n.LoadConfigOnly(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.SSHKeys) != 1 || config.SSHKeys[0] != validKey || config.Username != "admin" || config.Hostname != "lobby" {
+		t.Errorf("got keys %q, username %q and hostname %q, want the values read next to each file", config.SSHKeys, config.Username, config.Hostname)
+	}
+
+	runs, err := os.ReadFile(filepath.Join(common, "runs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(runs), "run"); got != 1 {
+		t.Errorf("!cmd ran %d times, want once", got)
+	}
+}
+
+func TestDeviceKeepsMarkers(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "sprout.yaml"), "a: {b: 1, c: 2}\ndevices:\n  kiosk:\n    a: !replace {c: 3}")
+
+	tree, err := (&Nix{}).readConfig(filepath.Join(dir, "sprout.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tree is reused, so applying a device twice gives the same result
+	for range 2 {
+		merged, _, err := tree.device("kiosk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got struct{ A map[string]int }
+		if err := merged.Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got.A) != 1 || got.A["c"] != 3 {
+			t.Errorf("got a = %v, want only c: 3", got.A)
+		}
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
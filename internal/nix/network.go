@@ -0,0 +1,95 @@
+package nix
+
+import (
+	"slices"
+
+	"github.com/fcjr/sprout/internal/schema"
+	"gopkg.in/yaml.v3"
+)
+
+// DHCPMode is whether an interface asks for addresses over DHCP, for both
+// address families or only one of them.
+type DHCPMode string
+
+const (
+	DHCPYes  DHCPMode = "yes"
+	DHCPNo   DHCPMode = "no"
+	DHCPIPv4 DHCPMode = "ipv4"
+	DHCPIPv6 DHCPMode = "ipv6"
+)
+
+func (d *DHCPMode) UnmarshalYAML(node *yaml.Node) error {
+	if node.ShortTag() == "!!bool" {
+		var enabled bool
+		if err := node.Decode(&enabled); err != nil {
+			return err
+		}
+		*d = DHCPNo
+		if enabled {
+			*d = DHCPYes
+		}
+		return nil
+	}
+	var mode string
+	if err := node.Decode(&mode); err != nil {
+		return err
+	}
+	*d = DHCPMode(mode)
+	return nil
+}
+
+// ExtendSchema accepts true or false, or the address family to use DHCP
+// for.
+func (DHCPMode) ExtendSchema(s *schema.Schema, g *schema.Generator) error {
+	*s = schema.Schema{OneOf: []*schema.Schema{
+		{Type: "boolean"},
+		{Type: "string", Enum: []any{string(DHCPIPv4), string(DHCPIPv6)}},
+	}}
+	return nil
+}
+
+type VLANConfig struct {
+	Parent string `yaml:"parent" doc:"Interface the VLAN is on, which has to be listed under interfaces as well" schema:"required;examples=[\"eth0\"]"`
+	ID     int    `yaml:"id" doc:"VLAN ID" schema:"required;minimum=1;maximum=4094"`
+}
+
+type InterfaceConfig struct {
+	DHCP      DHCPMode   `yaml:"dhcp" doc:"Ask for addresses over DHCP: true, false, or 'ipv4' or 'ipv6' for one address family only. Defaults to false when addresses are set and to true otherwise"`
+	Addresses []string   `yaml:"addresses" doc:"Static IPv4 and IPv6 addresses with their prefix length" schema:"examples=[[\"192.168.10.5/24\", \"fd00:10::5/64\"]]"`
+	Gateways  []string   `yaml:"gateways" doc:"Default gateways, one per address family" schema:"examples=[[\"192.168.10.1\", \"fd00:10::1\"]]"`
+	DNS       []string   `yaml:"dns" doc:"DNS servers" schema:"examples=[[\"192.168.10.1\", \"9.9.9.9\"]]"`
+	Domains   []string   `yaml:"domains" doc:"Search domains" schema:"pattern=^[A-Za-z0-9.-]+$;examples=[[\"plant.example.com\"]]"`
+	VLAN      VLANConfig `yaml:"vlan" doc:"Makes this interface a VLAN on another one, named after the key"`
+}
+
+// IsVLAN reports whether the interface is a VLAN created by Sprout.
+func (c InterfaceConfig) IsVLAN() bool {
+	return c.VLAN.Parent != ""
+}
+
+// DHCPSetting returns the DHCP= setting of the interface's network.
+func (c InterfaceConfig) DHCPSetting() DHCPMode {
+	switch {
+	case c.DHCP != "":
+		return c.DHCP
+	case len(c.Addresses) > 0:
+		return DHCPNo
+	}
+	return DHCPYes
+}
+
+type NetworkingConfig struct {
+	Interfaces map[string]InterfaceConfig `yaml:"interfaces" doc:"Wired interfaces and VLANs configured with systemd-networkd, keyed by interface name. Names of physical interfaces may be globs such as 'en*'. Interfaces not listed use DHCP" schema:"examples=[{\"eth0\": {\"addresses\": [\"192.168.10.5/24\"], \"gateways\": [\"192.168.10.1\"], \"dns\": [\"192.168.10.1\"]}}]"`
+}
+
+// VLANs returns the names of the VLANs on the parent interface, in order.
+func (c NetworkingConfig) VLANs(parent string) []string {
+	var names []string
+	for name, iface := range c.Interfaces {
+		if iface.VLAN.Parent == parent {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
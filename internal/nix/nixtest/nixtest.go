@@ -0,0 +1,141 @@
+// Package nixtest provides fake backends for running the image pipeline of
+// package nix without Docker or Nix.
+package nixtest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/docker/docker/api/types/container"
+
+	"github.com/fcjr/sprout/internal/nix"
+)
+
+// New returns a Nix whose backends are fakes working beneath dir.
+func New(dir string) (*nix.Nix, *Engine, *Builder, *Fetcher) {
+	engine := &Engine{}
+	builder := &Builder{Dir: dir}
+	fetcher := &Fetcher{}
+	nixInstance := &nix.Nix{
+		Hermetic: true,
+		WorkDir:  filepath.Join(dir, "work"),
+		Engine:   engine,
+		Builder:  builder,
+		Fetcher:  fetcher,
+	}
+	return nixInstance, engine, builder, fetcher
+}
+
+// Engine records the containers it is asked to run.
+type Engine struct {
+	mu sync.Mutex
+
+	// Pulls and Runs list the images pulled and the containers run.
+	Pulls []string
+	Runs  []*container.Config
+
+	// RunFunc, if set, is called for every container and returns its
+	// output.
+	RunFunc func(config *container.Config, hostConfig *container.HostConfig) (string, error)
+}
+
+func (e *Engine) Pull(ctx context.Context, image string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Pulls = append(e.Pulls, image)
+	return nil
+}
+
+func (e *Engine) Run(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, stream bool) (string, error) {
+	e.mu.Lock()
+	e.Runs = append(e.Runs, config)
+	e.mu.Unlock()
+	if e.RunFunc != nil {
+		return e.RunFunc(config, hostConfig)
+	}
+	return "", nil
+}
+
+// Builder keeps the Nix files it is asked to build and produces empty
+// images beneath Dir.
+type Builder struct {
+	Dir string
+
+	// Nix holds the contents of the Nix file of the last build.
+	Nix string
+	// Secrets holds the secret files installed into the last image, by
+	// name.
+	Secrets map[string]string
+}
+
+func (b *Builder) BuildImage(filename string, sproutFile *nix.SproutFile) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	b.Nix = string(data)
+
+	result := filepath.Join(b.Dir, "result")
+	imageDir := filepath.Join(result, "sd-image")
+	if err := os.MkdirAll(imageDir, 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(imageDir, "nixos.img"), []byte("image"), 0644); err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+func (b *Builder) InstallSecrets(imagePath, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	b.Secrets = make(map[string]string, len(entries))
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		b.Secrets[entry.Name()] = string(data)
+	}
+	return nil
+}
+
+func (b *Builder) BuildSproutBinary() (string, error) {
+	binDir := filepath.Join(b.Dir, "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		return "", err
+	}
+	binaryPath := filepath.Join(binDir, "sprout")
+	if err := os.WriteFile(binaryPath, []byte("sprout"), 0755); err != nil {
+		return "", err
+	}
+	return binaryPath, nil
+}
+
+// Fetcher records the images it is asked to build, pull and save, and
+// writes placeholder tarballs.
+type Fetcher struct {
+	Builds []string
+	Pulls  []string
+	Saves  []string
+}
+
+func (f *Fetcher) Build(service string, invocation *nix.ComposeInvocation) error {
+	f.Builds = append(f.Builds, service)
+	return nil
+}
+
+func (f *Fetcher) Pull(ctx context.Context, name string) error {
+	f.Pulls = append(f.Pulls, name)
+	return nil
+}
+
+func (f *Fetcher) Save(ctx context.Context, img nix.DockerImage) error {
+	f.Saves = append(f.Saves, img.LocalTag)
+	return os.WriteFile(img.TarPath, []byte(img.Name), 0644)
+}
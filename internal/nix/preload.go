@@ -0,0 +1,104 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+)
+
+// dataRootBuilderImage runs the throwaway dockerd that unpacks the embedded
+// images. It is pinned so builds are repeatable; the overlay2 layout it
+// writes is read by the Docker release on the device, which may be newer.
+const dataRootBuilderImage = "docker:27-dind"
+
+// dataRootScript loads every tarball in /work/images into a fresh dockerd
+// and packs the resulting data root into an ext4 filesystem image. This has
+// to happen in a privileged container rather than in the Nix sandbox, since
+// layer ownership, overlay whiteouts and xattrs can only be created as root.
+const dataRootScript = `set -e
+apk add --no-cache e2fsprogs >/dev/null
+dockerd --storage-driver=overlay2 --data-root=/var/lib/docker >/tmp/dockerd.log 2>&1 &
+tries=0
+until docker info >/dev/null 2>&1; do
+  tries=$((tries + 1))
+  if [ "$tries" -gt 60 ]; then cat /tmp/dockerd.log; exit 1; fi
+  sleep 1
+done
+for f in /work/images/*.tar; do docker load -i "$f"; done
+kill "$(cat /var/run/docker.pid)"
+while [ -e /var/run/docker.pid ]; do sleep 1; done
+rm -rf /var/lib/docker/network /var/lib/docker/containers /var/lib/docker/tmp /var/lib/docker/runtimes /var/lib/docker/buildkit /var/lib/docker/engine-id
+size=$(du -sm /var/lib/docker | cut -f1)
+mkfs.ext4 -q -L ` + dockerLabel + ` -d /var/lib/docker /work/docker-data.img "$((size + size / 5 + 256))M"
+`
+
+func (n *Nix) buildDockerDataRoot(sproutFile *SproutFile) error {
+	fmt.Printf("      \033[36mPreparing Docker data root...\033[0m\n")
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("failed to get home directory: %w", err)
+	}
+	workDir, err := os.MkdirTemp(homeDir, "sprout-preload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	imagesDir := filepath.Join(workDir, "images")
+	if err := os.MkdirAll(imagesDir, 0755); err != nil {
+		return fmt.Errorf("failed to create images directory: %w", err)
+	}
+	for _, img := range sproutFile.Images {
+		if err := n.copyFile(img.TarPath, filepath.Join(imagesDir, filepath.Base(img.TarPath))); err != nil {
+			return fmt.Errorf("failed to stage docker image %s: %w", img.TarPath, err)
+		}
+	}
+
+	ctx := context.Background()
+	if err := n.engine().Pull(ctx, dataRootBuilderImage); err != nil {
+		return err
+	}
+	if err := n.runDataRootBuilder(ctx, workDir); err != nil {
+		return err
+	}
+
+	stagingDir, err := n.stagingDir()
+	if err != nil {
+		return err
+	}
+	dataRootPath := filepath.Join(stagingDir, "docker-data.img")
+	if err := n.copyFile(filepath.Join(workDir, "docker-data.img"), dataRootPath); err != nil {
+		return fmt.Errorf("failed to save docker data root: %w", err)
+	}
+
+	sproutFile.DataRootPath = dataRootPath
+	fmt.Printf("      \033[32mDocker data root ready: %s\033[0m\n", dataRootPath)
+	return nil
+}
+
+func (n *Nix) runDataRootBuilder(ctx context.Context, workDir string) error {
+	containerConfig := &container.Config{
+		Image:      dataRootBuilderImage,
+		Entrypoint: []string{"/bin/sh", "-c", dataRootScript},
+	}
+	hostConfig := &container.HostConfig{
+		Mounts: []mount.Mount{
+			{
+				Type:   mount.TypeBind,
+				Source: workDir,
+				Target: "/work",
+			},
+		},
+		Privileged: true,
+	}
+
+	if _, err := n.engine().Run(ctx, containerConfig, hostConfig, false); err != nil {
+		return fmt.Errorf("data root builder failed: %w", err)
+	}
+	return nil
+}
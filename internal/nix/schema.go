@@ -0,0 +1,94 @@
+package nix
+
+import (
+	"reflect"
+
+	"github.com/fcjr/sprout/internal/schema"
+)
+
+// Schema returns the JSON schema of sprout.yaml, derived from SproutFile.
+// sprout.schema.json is generated from it with `sprout schema`.
+func Schema() ([]byte, error) {
+	var g schema.Generator
+	s, err := g.Generate(SproutFile{})
+	if err != nil {
+		return nil, err
+	}
+	s.Schema = "http://json-schema.org/draft-07/schema#"
+	s.ID = "https://raw.githubusercontent.com/fcjr/sprout/main/sprout.schema.json"
+	s.Title = "Sprout Configuration"
+	s.Description = "Configuration file for Sprout - a tool to generate NixOS SD card images from Docker Compose files"
+	return schema.Marshal(s)
+}
+
+// ExtendSchema requires one of the ways to give the key.
+func (NetworkConfig) ExtendSchema(s *schema.Schema, g *schema.Generator) error {
+	s.OneOf = []*schema.Schema{
+		{Required: []string{"psk"}},
+		{Required: []string{"psk_secret"}},
+		{Required: []string{"eap"}},
+	}
+	return nil
+}
+
+// ExtendSchema requires one of the two ways to give the password.
+func (EAPConfig) ExtendSchema(s *schema.Schema, g *schema.Generator) error {
+	s.OneOf = []*schema.Schema{
+		{Required: []string{"password"}},
+		{Required: []string{"password_secret"}},
+	}
+	return nil
+}
+
+// ExtendSchema accepts a map of SSID to network or a list of networks with
+// their SSID.
+func (WirelessNetworks) ExtendSchema(s *schema.Schema, g *schema.Generator) error {
+	network, err := g.Ref(reflect.TypeFor[NetworkConfig](), "wirelessNetwork")
+	if err != nil {
+		return err
+	}
+	*s = schema.Schema{OneOf: []*schema.Schema{
+		{Type: "object", AdditionalProperties: network},
+		{
+			Type:        "array",
+			Description: "Networks in order of preference",
+			Items: &schema.Schema{AllOf: []*schema.Schema{
+				network,
+				{Required: []string{"ssid"}},
+			}},
+		},
+	}}
+	return nil
+}
+
+// ExtendSchema requires enabled stacks to name their compose files.
+func (DockerComposeConfig) ExtendSchema(s *schema.Schema, g *schema.Generator) error {
+	s.Description = "A Docker Compose stack to embed in the image"
+	s.If = &schema.Schema{Properties: &schema.Properties{}}
+	s.If.Properties.Set("enabled", &schema.Schema{Const: true})
+	s.Then = &schema.Schema{AnyOf: []*schema.Schema{
+		{Required: []string{"path"}},
+		{Required: []string{"files"}},
+	}}
+	return nil
+}
+
+// ExtendSchema accepts a single stack or a list of named stacks.
+func (ComposeStacks) ExtendSchema(s *schema.Schema, g *schema.Generator) error {
+	stack, err := g.Ref(reflect.TypeFor[DockerComposeConfig](), "composeStack")
+	if err != nil {
+		return err
+	}
+	*s = schema.Schema{OneOf: []*schema.Schema{
+		{AllOf: []*schema.Schema{stack}, Required: []string{"enabled"}},
+		{
+			Type:        "array",
+			Description: "Independent stacks, each with its own project, working directory and systemd unit",
+			Items: &schema.Schema{AllOf: []*schema.Schema{
+				stack,
+				{Required: []string{"name"}},
+			}},
+		},
+	}}
+	return nil
+}
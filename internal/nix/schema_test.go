@@ -0,0 +1,18 @@
+package nix
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fcjr/sprout"
+)
+
+func TestSchemaIsCurrent(t *testing.T) {
+	generated, err := Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(generated, sprout.Schema) {
+		t.Error("sprout.schema.json is out of date with the config types; run `go generate` in the repository root")
+	}
+}
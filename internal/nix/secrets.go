@@ -0,0 +1,402 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	SecretsFormatSops = "sops"
+	SecretsFormatAge  = "age"
+)
+
+// deviceSecretsDir is where decrypted secrets are installed on the device.
+// It lives on the root filesystem rather than in the Nix store, so the
+// values never end up world-readable.
+const deviceSecretsDir = "/var/lib/sprout/secrets"
+
+// secretsInstallerImage runs debugfs when it is not installed locally.
+const secretsInstallerImage = "alpine:3.20"
+
+// testSecretValue stands in for every secret in VM tests, which build the
+// system in the Nix store and so must not see the real values.
+const testSecretValue = "sprout-test-secret"
+
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// loadSecrets decrypts the secrets file and stages one file per secret, plus
+// the env files consumed by wpa_supplicant and the compose unit, in a
+// private directory for the image build. Without stage only the names of the
+// secrets are needed; they are read from a sops file without decrypting it,
+// and the values are left empty.
+func (n *Nix) loadSecrets(sproutFile *SproutFile, configDir string, stage bool) error {
+	secrets := &sproutFile.Secrets
+	secretsFile := resolvePaths(configDir, []string{secrets.File})[0]
+
+	format := secrets.Format
+	if format == "" {
+		format = SecretsFormatSops
+		if filepath.Ext(secretsFile) == ".age" {
+			format = SecretsFormatAge
+		}
+	}
+
+	var plaintext []byte
+	var err error
+	switch {
+	case !stage && format == SecretsFormatSops:
+		// sops only encrypts the values
+		plaintext, err = os.ReadFile(secretsFile)
+	case format == SecretsFormatSops:
+		plaintext, err = n.decryptSops(secretsFile)
+	case format == SecretsFormatAge:
+		plaintext, err = n.decryptAge(secretsFile, secrets.Identity)
+	default:
+		return fmt.Errorf("invalid secrets.format %q: must be %q or %q", format, SecretsFormatSops, SecretsFormatAge)
+	}
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]any)
+	if err := yaml.Unmarshal(plaintext, &values); err != nil {
+		return fmt.Errorf("failed to parse decrypted secrets: %w", err)
+	}
+	if !stage && format == SecretsFormatSops {
+		delete(values, "sops")
+	}
+
+	secrets.Values = make(map[string]string, len(values))
+	for name, value := range values {
+		if !secretNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid secret name %q: must be a valid identifier", name)
+		}
+		switch value.(type) {
+		case map[string]any, []any:
+			return fmt.Errorf("secret %q must be a string, not a nested value", name)
+		}
+		if stage {
+			secrets.Values[name] = fmt.Sprint(value)
+		} else {
+			secrets.Values[name] = ""
+		}
+	}
+
+	for _, network := range sproutFile.Wireless.Networks {
+		for _, name := range []string{network.PSKSecret, network.EAP.PasswordSecret} {
+			if name != "" && !secrets.Has(name) {
+				return fmt.Errorf("wireless network %q references unknown secret %q", network.SSID, name)
+			}
+		}
+	}
+	for _, name := range secrets.Environment {
+		if !secrets.Has(name) {
+			return fmt.Errorf("secrets.environment references unknown secret %q", name)
+		}
+	}
+
+	if !stage {
+		return nil
+	}
+	return n.stageSecrets(sproutFile)
+}
+
+func (n *Nix) decryptSops(path string) ([]byte, error) {
+	cmd := exec.Command("sops", "--decrypt", "--output-type", "json", path)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s with sops: %w", path, err)
+	}
+	return output, nil
+}
+
+func (n *Nix) decryptAge(path, identity string) ([]byte, error) {
+	if identity == "" {
+		identity = os.Getenv("SOPS_AGE_KEY_FILE")
+	}
+	if identity == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get home directory: %w", err)
+		}
+		identity = filepath.Join(home, ".config", "sops", "age", "keys.txt")
+	}
+	if strings.HasPrefix(identity, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get home directory: %w", err)
+		}
+		identity = filepath.Join(home, identity[2:])
+	}
+
+	cmd := exec.Command("age", "--decrypt", "--identity", identity, path)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s with age: %w", path, err)
+	}
+	return output, nil
+}
+
+func (n *Nix) stageSecrets(sproutFile *SproutFile) error {
+	files, err := sproutFile.secretFiles(sproutFile.Secrets.Values)
+	if err != nil {
+		return err
+	}
+
+	stageDir, err := os.MkdirTemp("", "sprout-secrets-*")
+	if err != nil {
+		return fmt.Errorf("failed to create secrets directory: %w", err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(stageDir, name), []byte(content), 0600); err != nil {
+			os.RemoveAll(stageDir)
+			return fmt.Errorf("failed to stage %s: %w", name, err)
+		}
+	}
+
+	sproutFile.Secrets.Path = stageDir
+	return nil
+}
+
+// secretFiles returns the files installed in deviceSecretsDir: one per
+// secret, plus the env files consumed by wpa_supplicant and the compose
+// unit, filled in from values.
+func (s SproutFile) secretFiles(values map[string]string) (map[string]string, error) {
+	files := make(map[string]string, len(values)+2)
+	for name, value := range values {
+		files[name] = value
+	}
+
+	secrets := SecretsConfig{Values: values}
+	envFiles := map[string][]string{
+		"wireless.env": s.Wireless.secretNames(),
+		"compose.env":  s.Secrets.Environment,
+	}
+	for fileName, names := range envFiles {
+		content, err := secrets.envFile(names)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stage %s: %w", fileName, err)
+		}
+		files[fileName] = content
+	}
+	return files, nil
+}
+
+// TestSecretFiles returns the secret files with placeholder values, for VM
+// tests.
+func (s SproutFile) TestSecretFiles() (map[string]string, error) {
+	values := make(map[string]string, len(s.Secrets.Values))
+	for name := range s.Secrets.Values {
+		values[name] = testSecretValue
+	}
+	return s.secretFiles(values)
+}
+
+// envFile renders the named secrets as NAME=value lines.
+func (s *SecretsConfig) envFile(names []string) (string, error) {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+
+	var b strings.Builder
+	seen := make(map[string]bool)
+	for _, name := range sorted {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		value := s.Values[name]
+		if strings.ContainsAny(value, "\r\n") {
+			return "", fmt.Errorf("secret %q spans multiple lines and cannot be used as a variable", name)
+		}
+		fmt.Fprintf(&b, "%s=%s\n", name, value)
+	}
+	return b.String(), nil
+}
+
+// InstallSecrets writes the staged secrets into the root filesystem of the
+// built image at imagePath. This happens after the build so the decrypted
+// values never pass through the Nix store.
+func (n *Nix) InstallSecrets(imagePath string, sproutFile *SproutFile) error {
+	if sproutFile.Secrets.Path == "" {
+		return nil
+	}
+	return n.builder().InstallSecrets(imagePath, sproutFile.Secrets.Path)
+}
+
+// rootFilesystemOffset returns where the root filesystem starts in the
+// image at imagePath, checking that it is ext4, which debugfs can write.
+func rootFilesystemOffset(imagePath string) (int64, error) {
+	image, err := os.Open(imagePath)
+	if err != nil {
+		return 0, err
+	}
+	defer image.Close()
+
+	mbr := make([]byte, 512)
+	if _, err := image.ReadAt(mbr, 0); err != nil {
+		return 0, fmt.Errorf("failed to read the partition table of %s: %w", imagePath, err)
+	}
+	if binary.LittleEndian.Uint16(mbr[510:]) != 0xaa55 {
+		return 0, fmt.Errorf("%s has no DOS partition table", imagePath)
+	}
+	// The root filesystem is the second partition of every layout
+	offset := int64(binary.LittleEndian.Uint32(mbr[446+16+8:])) * 512
+
+	magic := make([]byte, 2)
+	if _, err := image.ReadAt(magic, offset+1024+56); err != nil {
+		return 0, fmt.Errorf("failed to read the root filesystem of %s: %w", imagePath, err)
+	}
+	if binary.LittleEndian.Uint16(magic) != 0xef53 {
+		return 0, fmt.Errorf("the root filesystem of %s is not ext4", imagePath)
+	}
+	return offset, nil
+}
+
+// debugfsCommands creates deviceSecretsDir and copies the files of the
+// staging directory into it, readable by root only. File names are relative
+// to the staging directory, which debugfs has to run in.
+func debugfsCommands(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read staged secrets: %w", err)
+	}
+
+	var b strings.Builder
+	owned := func(target, mode string) {
+		fmt.Fprintf(&b, "sif %s mode %s\nsif %s uid 0\nsif %s gid 0\n", target, mode, target, target)
+	}
+	parent := "/"
+	for _, part := range strings.Split(strings.TrimPrefix(deviceSecretsDir, "/"), "/") {
+		parent = path.Join(parent, part)
+		fmt.Fprintf(&b, "mkdir %s\n", parent)
+		if parent == deviceSecretsDir {
+			owned(parent, "040700")
+		} else {
+			owned(parent, "040755")
+		}
+	}
+	for _, entry := range entries {
+		target := path.Join(deviceSecretsDir, entry.Name())
+		fmt.Fprintf(&b, "rm %s\nwrite %s %s\n", target, entry.Name(), target)
+		owned(target, "0100600")
+	}
+	return b.String(), nil
+}
+
+// debugfsErrors picks the failures out of the error output of debugfs, which
+// exits successfully regardless. Directories that exist already and files
+// that are not there to be replaced are expected.
+func debugfsErrors(stderr string) error {
+	var failures []string
+	for _, line := range strings.Split(stderr, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "", strings.HasPrefix(line, "debugfs "),
+			strings.Contains(line, "directory already exists"),
+			strings.Contains(line, "File not found by ext2_lookup"):
+			continue
+		}
+		failures = append(failures, line)
+	}
+	if len(failures) > 0 {
+		return errors.New("debugfs failed: " + strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (n *Nix) installSecretsLocal(debugfsPath, imagePath, dir string) error {
+	offset, err := rootFilesystemOffset(imagePath)
+	if err != nil {
+		return err
+	}
+	commands, err := debugfsCommands(dir)
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(debugfsPath, "-w", "-f", "-", fmt.Sprintf("%s?offset=%d", imagePath, offset))
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(commands)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run debugfs: %w\nOutput: %s", err, stderr.String())
+	}
+	return debugfsErrors(stderr.String())
+}
+
+func (n *Nix) installSecretsWithDocker(imagePath, dir string) error {
+	offset, err := rootFilesystemOffset(imagePath)
+	if err != nil {
+		return err
+	}
+	absImage, err := filepath.Abs(imagePath)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("failed to get home directory: %w", err)
+	}
+	workDir, err := os.MkdirTemp(homeDir, "sprout-secrets-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	secretsDir := filepath.Join(workDir, "secrets")
+	if err := n.copyTree(dir, secretsDir); err != nil {
+		return fmt.Errorf("failed to copy staged secrets: %w", err)
+	}
+	commands, err := debugfsCommands(secretsDir)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "commands"), []byte(commands), 0600); err != nil {
+		return fmt.Errorf("failed to write debugfs commands: %w", err)
+	}
+
+	ctx := context.Background()
+	if err := n.engine().Pull(ctx, secretsInstallerImage); err != nil {
+		return err
+	}
+	script := fmt.Sprintf(`set -e
+apk add --no-cache e2fsprogs >/dev/null
+cd /work/secrets
+debugfs -w -f /work/commands "/image.img?offset=%d" >/dev/null 2>/work/errors`, offset)
+	containerConfig := &container.Config{
+		Image:      secretsInstallerImage,
+		Entrypoint: []string{"/bin/sh", "-c", script},
+	}
+	hostConfig := &container.HostConfig{
+		Mounts: []mount.Mount{
+			{Type: mount.TypeBind, Source: workDir, Target: "/work"},
+			{Type: mount.TypeBind, Source: absImage, Target: "/image.img"},
+		},
+	}
+	if _, err := n.engine().Run(ctx, containerConfig, hostConfig, false); err != nil {
+		return fmt.Errorf("secrets installer failed: %w", err)
+	}
+	stderr, err := os.ReadFile(filepath.Join(workDir, "errors"))
+	if err != nil {
+		return fmt.Errorf("failed to read debugfs output: %w", err)
+	}
+	return debugfsErrors(string(stderr))
+}
@@ -0,0 +1,124 @@
+package nix
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeImage writes an image with a DOS partition table whose second
+// partition starts at rootStart bytes.
+func writeImage(t *testing.T, rootStart, size int64) string {
+	t.Helper()
+	image := filepath.Join(t.TempDir(), "image.img")
+	mbr := make([]byte, 512)
+	binary.LittleEndian.PutUint32(mbr[446+16+8:], uint32(rootStart/512))
+	binary.LittleEndian.PutUint16(mbr[510:], 0xaa55)
+	if err := os.WriteFile(image, mbr, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(image, size); err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+func TestRootFilesystemOffset(t *testing.T) {
+	const rootStart = 4096 * 512
+	image := writeImage(t, rootStart, rootStart+4096)
+
+	if _, err := rootFilesystemOffset(image); err == nil || !strings.Contains(err.Error(), "not ext4") {
+		t.Errorf("rootFilesystemOffset() of a root without ext4 superblock = %v, want not ext4 error", err)
+	}
+
+	file, err := os.OpenFile(image, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte{0x53, 0xef}, rootStart+1024+56); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	offset, err := rootFilesystemOffset(image)
+	if err != nil {
+		t.Fatalf("rootFilesystemOffset() error = %v", err)
+	}
+	if offset != rootStart {
+		t.Errorf("rootFilesystemOffset() = %d, want %d", offset, rootStart)
+	}
+
+	if err := os.WriteFile(image, make([]byte, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rootFilesystemOffset(image); err == nil {
+		t.Error("rootFilesystemOffset() of an image without partition table succeeded")
+	}
+}
+
+func TestDebugfsErrors(t *testing.T) {
+	expected := `debugfs 1.47.0 (5-Feb-2023)
+ext2fs_mkdir: Ext2 directory already exists while creating directory "var"
+mkdir: Ext2 directory already exists
+rm: File not found by ext2_lookup while trying to resolve filename
+`
+	if err := debugfsErrors(expected); err != nil {
+		t.Errorf("debugfsErrors() = %v, want nil", err)
+	}
+
+	err := debugfsErrors(expected + "write: Could not allocate block in ext2 filesystem\n")
+	if err == nil || !strings.Contains(err.Error(), "Could not allocate block") {
+		t.Errorf("debugfsErrors() = %v, want the write failure", err)
+	}
+}
+
+func TestInstallSecretsLocal(t *testing.T) {
+	debugfs, err := exec.LookPath("debugfs")
+	if err != nil {
+		t.Skip("debugfs is not installed")
+	}
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is not installed")
+	}
+
+	const rootStart = 2048 * 512
+	image := writeImage(t, rootStart, rootStart+8<<20)
+	output, err := exec.Command("mkfs.ext4", "-q", "-F", "-E", fmt.Sprintf("offset=%d", rootStart), image, "8M").CombinedOutput()
+	if err != nil {
+		t.Fatalf("mkfs.ext4 failed: %v\n%s", err, output)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "api_token"), []byte("hunter2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	n := &Nix{}
+	// A second run replaces the files of the first
+	for range 2 {
+		if err := n.installSecretsLocal(debugfs, image, dir); err != nil {
+			t.Fatalf("installSecretsLocal() error = %v", err)
+		}
+	}
+
+	device := fmt.Sprintf("%s?offset=%d", image, rootStart)
+	got, err := exec.Command(debugfs, "-R", "cat "+deviceSecretsDir+"/api_token", device).Output()
+	if err != nil {
+		t.Fatalf("debugfs cat failed: %v", err)
+	}
+	if string(got) != "hunter2" {
+		t.Errorf("installed secret = %q, want %q", got, "hunter2")
+	}
+
+	stat, err := exec.Command(debugfs, "-R", "stat "+deviceSecretsDir+"/api_token", device).Output()
+	if err != nil {
+		t.Fatalf("debugfs stat failed: %v", err)
+	}
+	if !strings.Contains(string(stat), "Mode:  0600") || !strings.Contains(string(stat), "User:     0") {
+		t.Errorf("installed secret is not private to root:\n%s", stat)
+	}
+}
@@ -0,0 +1,121 @@
+package nix
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// stacksDir is where the compose projects live on the device, one
+// directory per stack.
+const stacksDir = "/etc/sprout/stacks"
+
+// deployedStacksDir holds stacks installed by `sprout deploy`. Unlike the
+// embedded projects it is writable by the device user.
+const deployedStacksDir = "/var/lib/sprout/stacks"
+
+// defaultStackName names the stack when docker_compose is a single mapping.
+const defaultStackName = "default"
+
+var stackNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// normalize fills in defaults and checks that stack names, dependencies and
+// runtime settings are consistent.
+func (s ComposeStacks) normalize() error {
+	names := make(map[string]bool)
+	for i := range s {
+		stack := &s[i]
+
+		if stack.Name == "" {
+			if len(s) > 1 {
+				return fmt.Errorf("docker_compose stack %d has no name: every stack in a list must be named", i+1)
+			}
+			stack.Name = defaultStackName
+		}
+		if !stackNamePattern.MatchString(stack.Name) {
+			return fmt.Errorf("invalid docker_compose stack name %q: use lowercase letters, digits, '-' and '_'", stack.Name)
+		}
+		if names[stack.Name] {
+			return fmt.Errorf("duplicate docker_compose stack name %q", stack.Name)
+		}
+		names[stack.Name] = true
+
+		switch stack.Preload {
+		case "":
+			stack.Preload = PreloadTarball
+		case PreloadTarball, PreloadDataRoot:
+		default:
+			return fmt.Errorf("invalid docker_compose.preload %q: must be %q or %q",
+				stack.Preload, PreloadTarball, PreloadDataRoot)
+		}
+
+		runtime := &stack.Runtime
+		switch runtime.Units {
+		case "":
+			runtime.Units = ComposeUnitsStack
+		case ComposeUnitsStack, ComposeUnitsService:
+		default:
+			return fmt.Errorf("invalid docker_compose.runtime.units %q: must be %q or %q",
+				runtime.Units, ComposeUnitsStack, ComposeUnitsService)
+		}
+		if runtime.WaitTimeout <= 0 {
+			runtime.WaitTimeout = 300
+		}
+		if runtime.HealthInterval <= 0 {
+			runtime.HealthInterval = 30
+		}
+	}
+
+	enabled := s.Enabled()
+	for _, stack := range enabled {
+		if stack.Preload != enabled[0].Preload {
+			return fmt.Errorf("stacks %s and %s use different preload modes: all stacks share one Docker daemon", enabled[0].Name, stack.Name)
+		}
+		for _, dependency := range stack.DependsOn {
+			target, ok := s.Stack(dependency)
+			if !ok {
+				return fmt.Errorf("stack %s depends on unknown stack %q", stack.Name, dependency)
+			}
+			if !target.Enabled {
+				return fmt.Errorf("stack %s depends on disabled stack %q", stack.Name, dependency)
+			}
+		}
+	}
+
+	return s.checkCycles()
+}
+
+// checkCycles makes sure stack dependencies can be ordered.
+func (s ComposeStacks) checkCycles() error {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("docker_compose stacks have a dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		stack, _ := s.Stack(name)
+		for _, dependency := range stack.DependsOn {
+			if err := visit(dependency, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		return nil
+	}
+
+	for _, stack := range s {
+		if err := visit(stack.Name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// SystemBuild is a built NixOS system closure, ready to be copied to a
+// running device with `sprout upgrade`.
+type SystemBuild struct {
+	// Toplevel is the store path of the system.
+	Toplevel string
+	// Paths is the closure of Toplevel.
+	Paths []string
+
+	// tempDir is the Docker build directory, if the system was built in
+	// a container.
+	tempDir string
+}
+
+// Close removes the build's temporary files.
+func (b *SystemBuild) Close() error {
+	if b.tempDir == "" {
+		return nil
+	}
+	return os.RemoveAll(b.tempDir)
+}
+
+// BuildSystem builds the system of the given Nix file instead of the SD
+// image, and computes its closure.
+func (n *Nix) BuildSystem(filename string, sproutFile *SproutFile) (*SystemBuild, error) {
+	isDisabled := os.Getenv("SPROUT_DISABLE_LOCAL_NIX") != ""
+	nixPath, hasNix := exec.LookPath("nix-build")
+
+	if !isDisabled && hasNix == nil {
+		fmt.Printf("      \033[36mUsing local Nix installation for faster builds...\033[0m\n")
+		return n.buildSystemLocal(nixPath, filename)
+	}
+
+	fmt.Printf("      \033[36mNix not found locally, using Docker build...\033[0m\n")
+	return n.buildSystemWithDocker(filename, sproutFile)
+}
+
+func (n *Nix) buildSystemLocal(nixPath, filename string) (*SystemBuild, error) {
+	absNixFile, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	cmd := exec.Command(nixPath, "--cores", "0", "--max-jobs", "auto", "--no-link", "-A", "toplevel", absNixFile)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build system: %w", err)
+	}
+	toplevel, err := n.extractNixStorePath(string(output))
+	if err != nil {
+		return nil, err
+	}
+
+	closure, err := exec.Command("nix-store", "--query", "--requisites", toplevel).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query closure of %s: %w", toplevel, err)
+	}
+
+	return &SystemBuild{Toplevel: toplevel, Paths: strings.Fields(string(closure))}, nil
+}
+
+func (n *Nix) buildSystemWithDocker(filename string, sproutFile *SproutFile) (*SystemBuild, error) {
+	tempDir, nixFileInTemp, err := n.prepareDockerBuildDir(filename, sproutFile)
+	if err != nil {
+		return nil, err
+	}
+	build := &SystemBuild{tempDir: tempDir}
+
+	if err := n.copyDockerImages(sproutFile, tempDir, nixFileInTemp); err != nil {
+		build.Close()
+		return nil, err
+	}
+
+	n.printDockerBuildInfo()
+
+	script := `set -e
+out=$(nix-build --cores 0 --max-jobs auto --no-link -A toplevel /workspace/image.nix)
+nix-store --query --requisites "$out" > /workspace/closure
+echo "$out"`
+	output, err := n.runBuilderScript(tempDir, script)
+	if err != nil {
+		build.Close()
+		return nil, err
+	}
+	build.Toplevel, err = n.extractNixStorePath(output)
+	if err != nil {
+		build.Close()
+		return nil, err
+	}
+
+	closure, err := os.ReadFile(filepath.Join(tempDir, "closure"))
+	if err != nil {
+		build.Close()
+		return nil, fmt.Errorf("failed to read closure: %w", err)
+	}
+	build.Paths = strings.Fields(string(closure))
+
+	return build, nil
+}
+
+// ExportPaths writes the given store paths of the build to w in the
+// `nix-store --export` format.
+func (n *Nix) ExportPaths(build *SystemBuild, paths []string, w io.Writer) error {
+	if build.tempDir == "" {
+		cmd := exec.Command("nix-store", append([]string{"--export"}, paths...)...)
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to export store paths: %w", err)
+		}
+		return nil
+	}
+
+	// The container's store is only reachable through the build directory
+	listPath := filepath.Join(build.tempDir, "export")
+	if err := os.WriteFile(listPath, []byte(strings.Join(paths, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write export list: %w", err)
+	}
+	defer os.Remove(listPath)
+
+	narPath := filepath.Join(build.tempDir, "closure.nar")
+	defer os.Remove(narPath)
+	if _, err := n.runBuilderScript(build.tempDir, `xargs nix-store --export < /workspace/export > /workspace/closure.nar`); err != nil {
+		return fmt.Errorf("failed to export store paths: %w", err)
+	}
+
+	nar, err := os.Open(narPath)
+	if err != nil {
+		return fmt.Errorf("failed to open exported store paths: %w", err)
+	}
+	defer nar.Close()
+	if _, err := io.Copy(w, nar); err != nil {
+		return fmt.Errorf("failed to send exported store paths: %w", err)
+	}
+	return nil
+}
+
+// runBuilderScript runs a shell script in the Nix builder container with
+// tempDir mounted at /workspace.
+func (n *Nix) runBuilderScript(tempDir, script string) (string, error) {
+	containerConfig, hostConfig, err := n.createDockerConfigs(tempDir, []string{"sh", "-c", script})
+	if err != nil {
+		return "", err
+	}
+	return n.engine().Run(context.Background(), containerConfig, hostConfig, true)
+}
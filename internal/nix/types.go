@@ -1,40 +1,488 @@
 package nix
 
-type Nix struct{}
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
 
-type NetworkConfig struct {
-	PSK string `yaml:"psk"`
-}
+	"gopkg.in/yaml.v3"
+)
+
+type Nix struct {
+	// Hermetic refuses build host environment variables when resolving
+	// compose projects.
+	Hermetic bool
+
+	// Device selects an entry of devices whose settings override the
+	// top-level ones. Empty uses the top-level settings.
+	Device string
+
+	// Overlays are merged over the configuration in order, after the files
+	// it extends.
+	Overlays []string
+
+	// WorkDir is where files for the build are staged, such as the Docker
+	// data root. If empty, a temporary directory is created on first use
+	// and removed by Close.
+	WorkDir string
+
+	// Engine, Builder and Fetcher replace the Docker daemon, nix-build and
+	// the Docker image sources. Nil fields use the real ones.
+	Engine  ContainerEngine
+	Builder Builder
+	Fetcher ImageFetcher
 
-type WirelessConfig struct {
-	Enabled  bool                     `yaml:"enabled"`
-	Networks map[string]NetworkConfig `yaml:"networks"`
+	// pulled are the pulled images saved by earlier loads, which are not
+	// pulled again when building several devices.
+	pulled map[string]bool
+
+	// trees are the configurations read so far, by file and overlays.
+	trees map[string]*configTree
+
+	// tempDir is the WorkDir created by stagingDir.
+	tempDir string
 }
 
 type OutputConfig struct {
-	Path string `yaml:"path"`
+	Path string `yaml:"path" doc:"Path where the built image should be saved (relative to sprout.yaml or absolute)" schema:"default=build/image.img;examples=[\"build/image.img\", \"/tmp/sprout-image.img\"]"`
+}
+
+// DefaultOutputPath is where the image is saved if output.path is not set.
+const DefaultOutputPath = "build/image.img"
+
+// resolve defaults the path and makes it absolute against configDir.
+func (o *OutputConfig) resolve(configDir string) {
+	if o.Path == "" {
+		o.Path = DefaultOutputPath
+	}
+	if !filepath.IsAbs(o.Path) {
+		o.Path = filepath.Join(configDir, o.Path)
+	}
+}
+
+const (
+	// LayoutSingle is the stock sd-image layout: a firmware partition and
+	// one root partition that is grown on first boot.
+	LayoutSingle = "single"
+	// LayoutAB adds a second root slot and a persistent data partition,
+	// so whole root images can be installed with a fallback.
+	LayoutAB = "ab"
+)
+
+// readonlyRootMount is where the root partition is mounted when the root
+// filesystem is a tmpfs.
+const readonlyRootMount = "/sprout/root"
+
+const (
+	RootFSExt4  = "ext4"
+	RootFSBtrfs = "btrfs"
+	// RootFSF2FS is flash-friendly but cannot be grown while mounted, so it
+	// is built at its final size.
+	RootFSF2FS = "f2fs"
+)
+
+// Filesystem labels of the partitions added to the card. dockerLabel is
+// used both for the Docker partition and for the prebuilt Docker data root.
+const (
+	dataLabel   = "SPROUT_DATA"
+	dockerLabel = "SPROUT_DOCKER"
+)
+
+type ImageConfig struct {
+	Layout          string   `yaml:"layout" doc:"'single' uses one root partition grown on first boot. 'ab' adds a second root slot and a persistent data partition, so whole images can be installed with 'sprout slot install' and fall back if they do not boot" schema:"enum=single,ab;default=single"`
+	FirmwareSize    int      `yaml:"firmware_size" doc:"Size of the firmware partition in MiB. Defaults to 256 when root_fs is not ext4, as the kernels are then booted from it" schema:"minimum=30"`
+	RootSize        int      `yaml:"root_size" doc:"Size the root partition is grown to on first boot in MiB, and the size of each root slot with the ab layout. Defaults to 4096 when partitions are added behind the root, and to the rest of the card otherwise" schema:"minimum=1024"`
+	RootFS          string   `yaml:"root_fs" doc:"Filesystem of the root and Docker partitions. f2fs cannot be grown and needs root_size" schema:"enum=ext4,btrfs,f2fs;default=ext4"`
+	DockerPartition bool     `yaml:"docker_partition" doc:"Keep /var/lib/docker on its own partition behind the root, created on first boot" schema:"default=false"`
+	DockerSize      int      `yaml:"docker_size" doc:"Size of the Docker partition in MiB. Required with readonly_root; otherwise the partition fills the rest of the card" schema:"minimum=1024"`
+	BootAttempts    int      `yaml:"boot_attempts" doc:"How many times a newly installed slot may fail to come up healthy before the device falls back to the previous one (ab layout)" schema:"minimum=1;default=3"`
+	ReadonlyRoot    bool     `yaml:"readonly_root" doc:"Mount the root partition read-only and run from a tmpfs, keeping journald logs in memory. Docker data, deployed stacks and the paths listed in 'persist' are kept on a separate data partition" schema:"default=false"`
+	Persist         []string `yaml:"persist" doc:"Absolute paths kept on the data partition across reboots (readonly_root or ab layout)" schema:"pattern=^/;examples=[[\"/home/sprout\", \"/var/lib/myapp\"]]"`
+}
+
+// AddedPartition is a partition created behind the root on first boot.
+type AddedPartition struct {
+	Number int
+	// Label is the filesystem label; unlabelled partitions are left
+	// unformatted.
+	Label string
+	// Size is in MiB; 0 fills the rest of the card.
+	Size int
+}
+
+// ABLayout reports whether the image has two root slots.
+func (c ImageConfig) ABLayout() bool {
+	return c.Layout == LayoutAB
+}
+
+// AddedPartitions returns the partitions created on first boot, in order.
+func (c ImageConfig) AddedPartitions() []AddedPartition {
+	var partitions []AddedPartition
+	if c.ABLayout() {
+		partitions = append(partitions, AddedPartition{Number: 3, Size: c.RootSize})
+	}
+	if c.DockerPartition {
+		partitions = append(partitions, AddedPartition{Number: 3, Label: dockerLabel, Size: c.DockerSize})
+	}
+	if c.HasDataPartition() {
+		partitions = append(partitions, AddedPartition{Number: len(partitions) + 3, Label: dataLabel})
+	}
+	return partitions
+}
+
+// CustomLayout reports whether the partitions are laid out by Sprout on
+// first boot rather than by growing the sd-image root partition.
+func (c ImageConfig) CustomLayout() bool {
+	return c.RootSize > 0 || c.RootFS != RootFSExt4 || len(c.AddedPartitions()) > 0
+}
+
+// KernelsOnFirmware reports whether the bootloader loads the kernels from
+// the firmware partition because U-Boot cannot read the root filesystem.
+func (c ImageConfig) KernelsOnFirmware() bool {
+	return c.RootFS != RootFSExt4
+}
+
+// FSTools returns the package with the tools for the root filesystem.
+func (c ImageConfig) FSTools() string {
+	switch c.RootFS {
+	case RootFSBtrfs:
+		return "btrfs-progs"
+	case RootFSF2FS:
+		return "f2fs-tools"
+	}
+	return "e2fsprogs"
+}
+
+// HasDataPartition reports whether a persistent data partition is created
+// on first boot.
+func (c ImageConfig) HasDataPartition() bool {
+	return c.ABLayout() || c.ReadonlyRoot
+}
+
+// RootMount returns where the root partition is mounted on the device.
+func (c ImageConfig) RootMount() string {
+	if c.ReadonlyRoot {
+		return readonlyRootMount
+	}
+	return "/"
 }
 
 type DockerImage struct {
 	Name     string
 	LocalTag string
 	TarPath  string
+	// Service is the compose service the image is built from, if any.
+	Service string
+}
+
+const (
+	// PreloadTarball ships each image as a tarball that is loaded on boot.
+	PreloadTarball = "tarball"
+	// PreloadDataRoot ships a prebuilt Docker data root with the images
+	// already unpacked, so containers can start without a load step.
+	PreloadDataRoot = "data-root"
+)
+
+const (
+	// ComposeUnitsStack runs the whole project from a single systemd unit.
+	ComposeUnitsStack = "stack"
+	// ComposeUnitsService runs every compose service in its own systemd
+	// unit, ordered by depends_on.
+	ComposeUnitsService = "service"
+)
+
+type ComposeRuntimeConfig struct {
+	Units          string `yaml:"units" doc:"'stack' runs the whole project from one systemd unit, 'service' generates one unit per compose service" schema:"enum=stack,service;default=stack"`
+	WaitTimeout    int    `yaml:"wait_timeout" doc:"Seconds to wait for all containers to become healthy on startup" schema:"minimum=1;default=300"`
+	HealthInterval int    `yaml:"health_interval" doc:"Seconds between container health checks" schema:"minimum=1;default=30"`
+}
+
+// ComposeService is a service of the embedded project and the services it
+// depends on.
+type ComposeService struct {
+	Name      string
+	DependsOn []string
 }
 
 type DockerComposeConfig struct {
-	Enabled         bool          `yaml:"enabled"`
-	Path            string        `yaml:"path"`
+	Name            string               `yaml:"name" doc:"Stack name, required when docker_compose is a list. Used for the project name (sprout-<name>), the working directory /etc/sprout/stacks/<name> and the systemd unit docker-compose-<name>" schema:"pattern=^[a-z0-9][a-z0-9_-]*$;default=default"`
+	DependsOn       []string             `yaml:"depends_on" doc:"Stacks that have to be up and healthy before this one is started"`
+	Enabled         bool                 `yaml:"enabled" doc:"Enable Docker Compose embedding. Stacks in a list are enabled unless set to false" schema:"default=false"`
+	Path            string               `yaml:"path" doc:"Path to docker-compose.yml file (relative to sprout.yaml or absolute)" schema:"examples=[\"docker-compose.yml\", \"./compose/app.yml\"]"`
+	Files           []string             `yaml:"files" doc:"Additional compose files layered on top of path, in order (relative to sprout.yaml or absolute)" schema:"examples=[[\"docker-compose.yml\", \"docker-compose.prod.yml\"]]"`
+	Profiles        []string             `yaml:"profiles" doc:"Compose profiles to activate; services outside them are not embedded"`
+	EnvFiles        []string             `yaml:"env_files" doc:"Env files used for compose interpolation (relative to sprout.yaml or absolute). Defaults to the .env next to the first compose file"`
+	Environment     []string             `yaml:"environment" doc:"Allow-list of variables for compose interpolation. NAME imports the variable from the build host, NAME=value sets it literally. When set, no other host variables are visible to the compose project" schema:"pattern=^[A-Za-z_][A-Za-z0-9_]*(=.*)?$;examples=[[\"IMAGE_TAG\", \"LOG_LEVEL=info\"]]"`
+	VolumeSeeds     map[string]string    `yaml:"volume_seeds" doc:"Map of named compose volume to a directory (relative to sprout.yaml or absolute) whose contents populate the volume the first time it is created on the device" schema:"examples=[{\"pgdata\": \"./seed/pgdata\"}]"`
+	Preload         string               `yaml:"preload" doc:"How embedded images are shipped: 'tarball' loads image tarballs on every boot, 'data-root' ships a prebuilt Docker data partition so containers start immediately" schema:"enum=tarball,data-root;default=tarball"`
+	Runtime         ComposeRuntimeConfig `yaml:"runtime" doc:"How the embedded project is run on the device"`
+	ProjectName     string
 	Content         string
 	ModifiedContent string
 	Images          []DockerImage
+	AssetsPath      string
+	Assets          []string
+	SeededVolumes   []SeededVolume
+	Services        []ComposeService
+
+	// deployed is set when the stack is processed for `sprout deploy`.
+	deployed bool
+}
+
+// ComposeFiles returns the compose files that make up the project, in the
+// order they are layered: Path first, followed by any additional Files.
+func (c DockerComposeConfig) ComposeFiles() []string {
+	var files []string
+	if c.Path != "" {
+		files = append(files, c.Path)
+	}
+	return append(files, c.Files...)
+}
+
+// UsesDataRoot reports whether images are shipped as a prebuilt Docker
+// data root rather than as tarballs.
+func (c DockerComposeConfig) UsesDataRoot() bool {
+	return c.Preload == PreloadDataRoot
+}
+
+// UnitPerService reports whether each compose service gets its own
+// systemd unit.
+func (c DockerComposeConfig) UnitPerService() bool {
+	return c.Runtime.Units == ComposeUnitsService
+}
+
+// WorkingDir returns the directory the stack's project lives in on the
+// device.
+func (c DockerComposeConfig) WorkingDir() string {
+	return path.Join(stacksDir, c.Name)
+}
+
+// DeployedDir returns where `sprout deploy` installs newer versions of the
+// stack on the device. When it holds a compose file, the stack's units use
+// it instead of the embedded project.
+func (c DockerComposeConfig) DeployedDir() string {
+	return path.Join(deployedStacksDir, c.Name)
+}
+
+// deviceDir returns the directory the project's files are installed to.
+func (c DockerComposeConfig) deviceDir() string {
+	if c.deployed {
+		return c.DeployedDir()
+	}
+	return c.WorkingDir()
+}
+
+// Unit returns the systemd unit that is active while the stack is up: the
+// stack's service, or the target grouping its per-service units.
+func (c DockerComposeConfig) Unit() string {
+	if c.UnitPerService() {
+		return fmt.Sprintf("docker-compose-%s.target", c.Name)
+	}
+	return fmt.Sprintf("docker-compose-%s.service", c.Name)
+}
+
+// ServiceUnit returns the name of the systemd unit running a single compose
+// service of the stack.
+func (c DockerComposeConfig) ServiceUnit(service string) string {
+	return fmt.Sprintf("docker-compose-%s-%s", c.Name, service)
+}
+
+// AssetsUnit returns the name of the systemd unit installing the stack's
+// embedded project files.
+func (c DockerComposeConfig) AssetsUnit() string {
+	return fmt.Sprintf("sprout-stack-assets-%s", c.Name)
+}
+
+// ComposeStacks is the docker_compose section. It is either a single stack
+// or a list of named stacks.
+type ComposeStacks []DockerComposeConfig
+
+func (s *ComposeStacks) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		var stack DockerComposeConfig
+		if err := node.Decode(&stack); err != nil {
+			return err
+		}
+		*s = ComposeStacks{stack}
+		return nil
+	}
+
+	stacks := make(ComposeStacks, len(node.Content))
+	for i, item := range node.Content {
+		// Listed stacks are enabled unless they say otherwise
+		stacks[i].Enabled = true
+		if err := item.Decode(&stacks[i]); err != nil {
+			return err
+		}
+	}
+	*s = stacks
+	return nil
+}
+
+// Enabled returns the stacks that are embedded in the image.
+func (s ComposeStacks) Enabled() ComposeStacks {
+	var enabled ComposeStacks
+	for _, stack := range s {
+		if stack.Enabled {
+			enabled = append(enabled, stack)
+		}
+	}
+	return enabled
+}
+
+// Stack returns the stack with the given name.
+func (s ComposeStacks) Stack(name string) (DockerComposeConfig, bool) {
+	for _, stack := range s {
+		if stack.Name == name {
+			return stack, true
+		}
+	}
+	return DockerComposeConfig{}, false
+}
+
+type SecretsConfig struct {
+	File        string   `yaml:"file" doc:"Path to a sops- or age-encrypted file containing a flat map of secret names to values (relative to sprout.yaml or absolute)" schema:"required;examples=[\"secrets.sops.yaml\", \"secrets.yaml.age\"]"`
+	Format      string   `yaml:"format" doc:"Encryption format. Defaults to 'age' for .age files and 'sops' otherwise" schema:"enum=sops,age"`
+	Identity    string   `yaml:"identity" doc:"age identity file used to decrypt (age format only). Defaults to $SOPS_AGE_KEY_FILE or ~/.config/sops/age/keys.txt"`
+	Environment []string `yaml:"environment" doc:"Secrets exposed to the compose project as environment variables at runtime"`
+	Values      map[string]string
+	Path        string
 }
 
+// Has reports whether the decrypted secrets contain name.
+func (s SecretsConfig) Has(name string) bool {
+	_, ok := s.Values[name]
+	return ok
+}
+
+// TestConfig holds the assertions `sprout test` checks in addition to the
+// built-in ones.
+type TestConfig struct {
+	Memory   int      `yaml:"memory" doc:"Memory of the test machine in MiB" schema:"minimum=512;default=2048"`
+	Units    []string `yaml:"units" doc:"systemd units that have to become active" schema:"examples=[[\"myapp.service\"]]"`
+	Ports    []int    `yaml:"ports" doc:"TCP ports that have to be listened on" schema:"minimum=1;maximum=65535;examples=[[80, 443]]"`
+	Commands []string `yaml:"commands" doc:"Shell commands that have to succeed on the machine" schema:"examples=[[\"curl -sf http://localhost/health\"]]"`
+	Script   string   `yaml:"script" doc:"Python run by the NixOS test driver after the other checks, with the machine available as 'machine'"`
+}
+
+// DefaultHostname is the hostname of devices that do not set one.
+const DefaultHostname = "sprout"
+
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
 type SproutFile struct {
-	SSHKeys          []string            `yaml:"ssh_keys"`
-	Username         string              `yaml:"username"`
-	Wireless         WirelessConfig      `yaml:"wireless"`
-	Output           OutputConfig        `yaml:"output"`
-	DockerCompose    DockerComposeConfig `yaml:"docker_compose"`
-	Autodiscovery    bool                `yaml:"autodiscovery"`
+	SSHKeys          []string         `yaml:"ssh_keys" doc:"List of SSH public keys to enable remote access" schema:"minItems=1;pattern=^(ssh-rsa|ssh-ed25519|ecdsa-sha2-nistp256|ecdsa-sha2-nistp384|ecdsa-sha2-nistp521) [A-Za-z0-9+/]+=*( .*)?$;examples=[[\"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIExample... user@host\"]]"`
+	Username         string           `yaml:"username" doc:"Username for the created user account (defaults to 'sprout')" schema:"default=sprout;pattern=^[a-z_][a-z0-9_-]*$;examples=[\"sprout\", \"pi\", \"admin\"]"`
+	Hostname         string           `yaml:"hostname" doc:"Hostname of the device, which it is also advertised under by 'sprout discover'. Devices without their own default to their name (defaults to 'sprout')" schema:"default=sprout;pattern=^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$;examples=[\"sprout\", \"kiosk-1\"]"`
+	Timezone         string           `yaml:"timezone" doc:"IANA time zone of the system (defaults to UTC)" schema:"pattern=^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$;examples=[\"UTC\", \"Europe/Berlin\", \"America/New_York\"]"`
+	Locale           string           `yaml:"locale" doc:"Default locale of the system (defaults to en_US.UTF-8)" schema:"pattern=^([a-z]{2,3}(_[A-Z]{2})?|C)\\.UTF-8(@[a-z]+)?$;examples=[\"en_US.UTF-8\", \"de_DE.UTF-8\"]"`
+	Keyboard         string           `yaml:"keyboard" doc:"Keymap of the console (defaults to us)" schema:"pattern=^[A-Za-z0-9_-]+$;examples=[\"us\", \"de\", \"fr\"]"`
+	NTPServers       []string         `yaml:"ntp_servers" doc:"NTP servers the clock is synchronized with, instead of the NixOS pool" schema:"pattern=^[A-Za-z0-9.:-]+$;examples=[[\"time.cloudflare.com\", \"192.168.1.1\"]]"`
+	Wireless         WirelessConfig   `yaml:"wireless" doc:"Wireless network configuration"`
+	Network          NetworkingConfig `yaml:"network" doc:"Wired network configuration, such as static addresses and VLANs"`
+	Output           OutputConfig     `yaml:"output" doc:"Output configuration for the generated image"`
+	Image            ImageConfig      `yaml:"image" doc:"Partition layout of the generated image"`
+	DockerCompose    ComposeStacks    `yaml:"docker_compose" doc:"Docker Compose configuration to embed in the image: a single stack, or a list of named stacks"`
+	Autodiscovery    bool             `yaml:"autodiscovery" doc:"Enable mDNS/Bonjour broadcasting for network discovery via 'sprout discover'" schema:"default=false"`
+	Secrets          SecretsConfig    `yaml:"secrets" doc:"Encrypted secrets decrypted at build time and installed on the device outside the Nix store, readable by root only"`
+	Test             TestConfig       `yaml:"test" doc:"Assertions checked by 'sprout test' in addition to the built-in ones"`
+	Extends          Extends          `yaml:"extends" doc:"Files this one builds on, relative to it, merged in order before it. Mappings are merged, lists tagged !append are appended to and other values, and mappings tagged !replace, are replaced" schema:"examples=[\"base.yaml\", [\"base.yaml\", \"wifi.yaml\"]]"`
+	Devices          Devices          `yaml:"devices" doc:"Devices built from this file, keyed by name, each overriding some of the settings above. Mappings are merged, other values replaced. Build one with 'sprout seed --device <name>' or all with '--all-devices'" schema:"examples=[{\"kiosk-1\": {\"docker_compose\": {\"environment\": [\"SITE=north\"]}}}]"`
 	SproutBinaryPath string
+	// Images are the Docker images of all stacks, without duplicates.
+	Images       []DockerImage
+	DataRootPath string
+}
+
+// WirelessSecrets reports whether any wireless network reads its key or
+// password from the secrets file.
+func (s SproutFile) WirelessSecrets() bool {
+	return len(s.Wireless.secretNames()) > 0
+}
+
+// NeedsSproutBinary reports whether the image runs the sprout binary, for
+// discovery or for installing root images.
+func (s SproutFile) NeedsSproutBinary() bool {
+	return s.Autodiscovery || s.Image.ABLayout()
+}
+
+// PersistentPaths returns the paths that are bind mounted from the data
+// partition.
+func (s SproutFile) PersistentPaths() []string {
+	if !s.Image.HasDataPartition() {
+		return nil
+	}
+	var paths []string
+	if len(s.DockerCompose.Enabled()) > 0 && !s.Image.DockerPartition {
+		paths = append(paths, "/var/lib/docker", deployedStacksDir)
+	}
+	for _, p := range s.Image.Persist {
+		if !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// UsesDataRoot reports whether images are shipped as a prebuilt Docker
+// data root. All stacks share one Docker daemon, so they have to agree.
+func (s SproutFile) UsesDataRoot() bool {
+	stacks := s.DockerCompose.Enabled()
+	return len(stacks) > 0 && stacks[0].UsesDataRoot()
+}
+
+// DataRootPartition reports whether the image has a partition with a
+// prebuilt Docker data root, which it has when there are images to preload.
+func (s SproutFile) DataRootPartition() bool {
+	return s.UsesDataRoot() && len(s.Images) > 0
+}
+
+// ExpandOnBoot reports whether the root partition is grown to fill the card
+// on first boot. It is not when Sprout lays out the partitions itself, or
+// when the Docker data root is the last partition and grown instead.
+func (s SproutFile) ExpandOnBoot() bool {
+	return !s.Image.CustomLayout() && !s.DataRootPartition()
+}
+
+// HealthUnits returns the systemd units that have to be active for the
+// device to count as healthy: SSH, the Sprout daemon and the compose
+// stacks. Other units failing does not roll an upgrade or a slot back.
+func (s SproutFile) HealthUnits() []string {
+	units := []string{"sshd.service"}
+	if s.Autodiscovery {
+		units = append(units, "sprout-daemon.service")
+	}
+	for _, stack := range s.DockerCompose.Enabled() {
+		if !stack.UnitPerService() {
+			units = append(units, stack.Unit())
+			continue
+		}
+		for _, service := range stack.Services {
+			units = append(units, stack.ServiceUnit(service.Name)+".service")
+		}
+	}
+	return units
+}
+
+// ComposeDependencies returns the systemd units that have to be up before
+// the given stack is started.
+func (s SproutFile) ComposeDependencies(stack DockerComposeConfig) []string {
+	units := []string{"docker.service"}
+	if len(s.Images) > 0 && !s.UsesDataRoot() {
+		units = append(units, "docker-load-images.service")
+	}
+	if stack.AssetsPath != "" {
+		units = append(units, stack.AssetsUnit()+".service")
+	}
+	if s.Secrets.File != "" {
+		units = append(units, "sprout-secrets.service")
+	}
+	for _, name := range stack.DependsOn {
+		if dependency, ok := s.DockerCompose.Stack(name); ok {
+			units = append(units, dependency.Unit())
+		}
+	}
+	return units
 }
@@ -0,0 +1,625 @@
+package nix
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/compose-spec/compose-go/v2/cli"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/santhosh-tekuri/jsonschema/v6/kind"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"gopkg.in/yaml.v3"
+
+	"github.com/fcjr/sprout"
+)
+
+// Problem is a mistake in a sprout.yaml. Line and Column are 0 for problems
+// that cannot be tied to one place in the file.
+type Problem struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", p.File, p.Line, p.Column, p.Message)
+}
+
+// ValidationError lists every problem found in a sprout.yaml.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0].String()
+	}
+	return fmt.Sprintf("%d problems found, the first is %s", len(e.Problems), e.Problems[0])
+}
+
+// reservedUsernames are accounts NixOS creates itself.
+var reservedUsernames = []string{
+	"root", "nobody", "daemon", "bin", "sys", "sshd", "messagebus", "avahi",
+	"systemd-network", "systemd-resolve", "systemd-timesync", "systemd-oom",
+	"systemd-coredump", "nixbld", "docker", "wpa_supplicant",
+}
+
+// sshKeyTypes are the key types accepted in ssh_keys.
+var sshKeyTypes = []string{
+	"ssh-rsa", "ssh-ed25519", "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521",
+}
+
+var hexPSKPattern = regexp.MustCompile(`^[0-9A-Fa-f]{64}$`)
+
+// Validate checks a sprout.yaml against sprout.schema.json, rejecting
+// unknown fields, and then checks the values the schema cannot: SSH keys,
+// compose files, wireless limits, network addresses and the username. Every problem found is
+// returned in a *ValidationError.
+func (n *Nix) Validate(filename string) error {
+	v := &validation{file: filename}
+	tree, err := n.readConfig(filename)
+	var configErr *configError
+	if errors.As(err, &configErr) {
+		v.configError(configErr)
+		return v.err()
+	}
+	if err != nil {
+		return err
+	}
+	if len(tree.root.Content) == 0 {
+		v.add(nil, "the file is empty")
+		return v.err()
+	}
+	v.tree, v.root = tree, tree.root
+
+	schema, err := compileSchema()
+	if err != nil {
+		return fmt.Errorf("failed to compile sprout.schema.json: %w", err)
+	}
+	sproutFile, err := v.check(schema)
+	if err != nil {
+		return err
+	}
+
+	// Devices are checked with their overrides merged in, so problems in
+	// the overrides are reported where they are
+	var devices []string
+	if sproutFile != nil {
+		devices = sproutFile.Devices.Names()
+	}
+	top := v.root
+	for _, name := range devices {
+		v.root = top
+		device := mappingValue(mappingValue(top, "devices"), name)
+		if device == nil || device.Kind != yaml.MappingNode {
+			// Reported by the schema
+			continue
+		}
+		if !deviceNamePattern.MatchString(name) {
+			v.add(v.lookup([]string{"devices", name}, true), "device %q: names may only contain letters, digits, '.', '_' and '-'", name)
+		} else if mappingValue(device, "hostname") == nil && !hostnamePattern.MatchString(name) {
+			v.add(v.lookup([]string{"devices", name}, true), "device %q: the name is not a valid hostname, so the device needs a hostname of its own", name)
+		}
+		merged, _, err := tree.device(name)
+		if errors.As(err, &configErr) {
+			v.configError(configErr)
+			continue
+		}
+		if err != nil {
+			v.add(v.lookup([]string{"devices", name}, true), "%v", err)
+			continue
+		}
+		v.root, v.device = merged, name
+		if _, err := v.check(schema); err != nil {
+			return err
+		}
+	}
+	v.root, v.device = top, ""
+	if n.Device != "" && !slices.Contains(devices, n.Device) {
+		v.add(nil, "no device named %q in devices", n.Device)
+	}
+
+	// Rules spanning several settings are checked while loading
+	if len(v.problems) == 0 {
+		for _, name := range append([]string{""}, devices...) {
+			device := *n
+			device.Device = name
+			if _, err := device.LoadConfigOnly(filename); err != nil && name == "" {
+				v.add(nil, "%v", err)
+			} else if err != nil {
+				v.add(nil, "device %s: %v", name, err)
+			}
+		}
+	}
+	return v.err()
+}
+
+// check validates v.root against the schema and checks the values the
+// schema cannot. It returns the decoded settings, or nil if they do not
+// decode.
+func (v *validation) check(schema *jsonschema.Schema) (*SproutFile, error) {
+	if err := schema.Validate(yamlValue(v.root)); err != nil {
+		var schemaErr *jsonschema.ValidationError
+		if !errors.As(err, &schemaErr) {
+			return nil, err
+		}
+		v.schemaError(schemaErr)
+	}
+
+	var sproutFile SproutFile
+	if err := v.root.Decode(&sproutFile); err != nil {
+		// Type mismatches have been reported by the schema
+		return nil, nil
+	}
+	v.checkSSHKeys(sproutFile.SSHKeys)
+	v.checkUsername(sproutFile.Username)
+	v.checkWireless(sproutFile.Wireless)
+	v.checkNetwork(sproutFile.Network)
+	v.checkCompose(sproutFile.DockerCompose)
+	return &sproutFile, nil
+}
+
+func compileSchema() (*jsonschema.Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(sprout.Schema))
+	if err != nil {
+		return nil, err
+	}
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("sprout.schema.json", doc); err != nil {
+		return nil, err
+	}
+	return compiler.Compile("sprout.schema.json")
+}
+
+// yamlValue converts a YAML node to the JSON value the schema is checked
+// against.
+func yamlValue(node *yaml.Node) any {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		return yamlValue(node.Content[0])
+	case yaml.AliasNode:
+		return yamlValue(node.Alias)
+	case yaml.MappingNode:
+		m := make(map[string]any, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			m[node.Content[i].Value] = yamlValue(node.Content[i+1])
+		}
+		return m
+	case yaml.SequenceNode:
+		s := make([]any, len(node.Content))
+		for i, item := range node.Content {
+			s[i] = yamlValue(item)
+		}
+		return s
+	}
+
+	var value any
+	if err := node.Decode(&value); err != nil {
+		return node.Value
+	}
+	return value
+}
+
+// validation collects the problems of one file.
+type validation struct {
+	file     string
+	tree     *configTree
+	root     *yaml.Node
+	problems []Problem
+	// device is the device whose overrides are merged into root.
+	device string
+}
+
+func (v *validation) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	// In file order, with problems of the whole file last
+	slices.SortStableFunc(v.problems, func(a, b Problem) int {
+		if (a.Line == 0) != (b.Line == 0) {
+			return cmp.Compare(b.Line, a.Line)
+		}
+		return cmp.Or(cmp.Compare(a.Line, b.Line), cmp.Compare(a.Column, b.Column))
+	})
+	return &ValidationError{Problems: v.problems}
+}
+
+// add records a problem at node, or for the whole file if node is nil.
+func (v *validation) add(node *yaml.Node, format string, args ...any) {
+	problem := Problem{File: v.file, Message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		problem.Line, problem.Column = node.Line, node.Column
+		if source := v.tree.source(node); source != "" {
+			problem.File = source
+		}
+	}
+	// Settings a device inherits have been checked at the top level
+	if v.device != "" && node != nil && slices.ContainsFunc(v.problems, func(p Problem) bool {
+		return p.Line == problem.Line && p.Column == problem.Column
+	}) {
+		return
+	}
+	if !slices.Contains(v.problems, problem) {
+		v.problems = append(v.problems, problem)
+	}
+}
+
+var yamlLinePattern = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// configError records a problem reading one of the files of the
+// configuration, such as a syntax error.
+func (v *validation) configError(err *configError) {
+	problem := Problem{File: err.File, Message: strings.TrimPrefix(err.Err.Error(), "yaml: ")}
+	if m := yamlLinePattern.FindStringSubmatch(err.Err.Error()); m != nil {
+		problem.Line, _ = strconv.Atoi(m[1])
+		problem.Column, problem.Message = 1, m[2]
+	} else if err.Node != nil {
+		problem.Line, problem.Column = err.Node.Line, err.Node.Column
+	}
+	if !slices.Contains(v.problems, problem) {
+		v.problems = append(v.problems, problem)
+	}
+}
+
+// lookup returns the node at path, where path holds mapping keys and
+// sequence indexes. With key set, the key of the last mapping entry is
+// returned instead of its value. It returns the deepest node found if the
+// path does not exist.
+func (v *validation) lookup(path []string, key bool) *yaml.Node {
+	node := v.root
+	for i, token := range path {
+		for node.Kind == yaml.AliasNode {
+			node = node.Alias
+		}
+		switch node.Kind {
+		case yaml.MappingNode:
+			found := false
+			for j := 0; j+1 < len(node.Content); j += 2 {
+				if node.Content[j].Value == token {
+					if key && i == len(path)-1 {
+						return node.Content[j]
+					}
+					node, found = node.Content[j+1], true
+					break
+				}
+			}
+			if !found {
+				return node
+			}
+		case yaml.SequenceNode:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(node.Content) {
+				return node
+			}
+			node = node.Content[index]
+		default:
+			return node
+		}
+	}
+	return node
+}
+
+func (v *validation) at(path ...string) *yaml.Node {
+	return v.lookup(path, false)
+}
+
+var printer = message.NewPrinter(language.English)
+
+// schemaError records the failed leaves of a schema validation error.
+// Branches of oneOf and anyOf whose type does not match at all are left
+// out, as they only say that the value is not of another accepted form.
+func (v *validation) schemaError(err *jsonschema.ValidationError) {
+	switch k := err.ErrorKind.(type) {
+	case *kind.AdditionalProperties:
+		for _, property := range k.Properties {
+			path := append(slices.Clone(err.InstanceLocation), property)
+			v.add(v.lookup(path, true), "unknown field %q in %s", property, v.describe(err.InstanceLocation))
+		}
+		return
+	case *kind.OneOf, *kind.AnyOf:
+		var applicable []*jsonschema.ValidationError
+		for _, cause := range err.Causes {
+			if !typeMismatch(cause, err.InstanceLocation) {
+				applicable = append(applicable, cause)
+			}
+		}
+		if missing, location := requiredAlternatives(applicable); len(missing) == 1 {
+			v.add(v.at(location...), "%s: needs %s", v.describe(location), missing[0])
+			return
+		} else if len(missing) > 0 {
+			v.add(v.at(location...), "%s: needs one of %s", v.describe(location), strings.Join(missing, ", "))
+			return
+		}
+		if len(applicable) > 0 {
+			for _, cause := range applicable {
+				v.schemaError(cause)
+			}
+			return
+		}
+	}
+
+	if len(err.Causes) > 0 {
+		for _, cause := range err.Causes {
+			v.schemaError(cause)
+		}
+		return
+	}
+	v.add(v.at(err.InstanceLocation...), "%s: %s", v.describe(err.InstanceLocation), schemaMessage(err.ErrorKind))
+}
+
+// schemaMessage describes a failed schema keyword. Numeric limits are
+// spelled out, since the library formats them with thousands separators.
+func schemaMessage(errorKind jsonschema.ErrorKind) string {
+	switch k := errorKind.(type) {
+	case *kind.Minimum:
+		return fmt.Sprintf("must be at least %s, got %s", k.Want.RatString(), k.Got.RatString())
+	case *kind.Maximum:
+		return fmt.Sprintf("must be at most %s, got %s", k.Want.RatString(), k.Got.RatString())
+	}
+	return errorKind.LocalizedString(printer)
+}
+
+// requiredAlternatives returns the missing properties, and where they are
+// missing, if every branch of a oneOf or anyOf only failed for want of one
+// in the same place.
+func requiredAlternatives(branches []*jsonschema.ValidationError) ([]string, []string) {
+	var missing, location []string
+	for i, branch := range branches {
+		for len(branch.Causes) == 1 {
+			branch = branch.Causes[0]
+		}
+		required, ok := branch.ErrorKind.(*kind.Required)
+		if !ok || len(branch.Causes) > 0 || (i > 0 && !slices.Equal(branch.InstanceLocation, location)) {
+			return nil, nil
+		}
+		missing = append(missing, required.Missing...)
+		location = branch.InstanceLocation
+	}
+	return missing, location
+}
+
+// typeMismatch reports whether err only says the value at location is not
+// of the type a schema branch expects.
+func typeMismatch(err *jsonschema.ValidationError, location []string) bool {
+	if len(err.Causes) == 0 {
+		_, isType := err.ErrorKind.(*kind.Type)
+		return isType && slices.Equal(err.InstanceLocation, location)
+	}
+	for _, cause := range err.Causes {
+		if !typeMismatch(cause, location) {
+			return false
+		}
+	}
+	return true
+}
+
+// describe names the setting at a location, e.g. docker_compose[0].path.
+func (v *validation) describe(location []string) string {
+	if len(location) == 0 && v.device != "" {
+		return fmt.Sprintf("device %q", v.device)
+	}
+	if len(location) == 0 {
+		return "the top level"
+	}
+	var b strings.Builder
+	for i, token := range location {
+		if _, err := strconv.Atoi(token); err == nil {
+			fmt.Fprintf(&b, "[%s]", token)
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(token)
+	}
+	return b.String()
+}
+
+func (v *validation) checkSSHKeys(keys []string) {
+	for i, key := range keys {
+		if err := parseSSHKey(key); err != nil {
+			v.add(v.at("ssh_keys", strconv.Itoa(i)), "ssh_keys[%d]: %v", i, err)
+		}
+	}
+}
+
+// parseSSHKey checks that an authorized_keys line holds a key of a
+// supported type whose encoded blob matches that type.
+func parseSSHKey(key string) error {
+	fields := strings.Fields(key)
+	if len(fields) < 2 {
+		return fmt.Errorf("not an SSH public key, expected \"<type> <key> [comment]\"")
+	}
+	if !slices.Contains(sshKeyTypes, fields[0]) {
+		return fmt.Errorf("unsupported key type %q", fields[0])
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return fmt.Errorf("the key is not valid base64")
+	}
+	if len(blob) < 4 || int(binary.BigEndian.Uint32(blob)) > len(blob)-4 {
+		return fmt.Errorf("the key is truncated")
+	}
+	length := binary.BigEndian.Uint32(blob)
+	if blobType := string(blob[4 : 4+length]); blobType != fields[0] {
+		return fmt.Errorf("the key is a %s key but is labelled %s", blobType, fields[0])
+	}
+	if fields[0] == "ssh-ed25519" && len(blob) != 4+int(length)+4+32 {
+		return fmt.Errorf("the key is truncated")
+	}
+	return nil
+}
+
+func (v *validation) checkUsername(username string) {
+	if username == "" {
+		return
+	}
+	if len(username) > 32 {
+		v.add(v.at("username"), "username: must be at most 32 characters long")
+	}
+	if slices.Contains(reservedUsernames, username) {
+		v.add(v.at("username"), "username: %q is a system account", username)
+	}
+}
+
+func (v *validation) checkWireless(wireless WirelessConfig) {
+	list := v.at("wireless", "networks").Kind == yaml.SequenceNode
+	for i, network := range wireless.Networks {
+		ssid := network.SSID
+		path := []string{"wireless", "networks", ssid}
+		if list {
+			path[2] = strconv.Itoa(i)
+			if slices.ContainsFunc(wireless.Networks[:i], func(other NetworkConfig) bool { return other.SSID == ssid }) {
+				v.add(v.at(append(path, "ssid")...), "wireless network %q is listed twice", ssid)
+			}
+		}
+		ssidNode := v.at(append(path, "ssid")...)
+		if !list && ssidNode.Kind == yaml.ScalarNode {
+			v.add(ssidNode, "wireless network %q: ssid is only used in a list of networks; here the key is the SSID", ssid)
+		}
+		if !list {
+			ssidNode = v.lookup(path, true)
+		}
+		// A listed network without ssid is reported by the schema
+		if (len(ssid) == 0 || len(ssid) > 32) && ssidNode.Kind == yaml.ScalarNode {
+			v.add(ssidNode, "wireless network %q: SSIDs are 1 to 32 bytes long", ssid)
+		}
+
+		keyMgmt := network.KeyManagement()
+		eap := network.EAP.Identity != ""
+		switch {
+		case keyMgmt == KeyMgmtWPAEAP && !eap:
+			v.add(v.at(append(path, "key_mgmt")...), "wireless network %q: %s needs eap credentials", ssid, KeyMgmtWPAEAP)
+		case keyMgmt != KeyMgmtWPAEAP && eap:
+			v.add(v.at(append(path, "key_mgmt")...), "wireless network %q: eap credentials need key_mgmt %s", ssid, KeyMgmtWPAEAP)
+		}
+		for _, field := range []struct {
+			key, value string
+		}{{"identity", network.EAP.Identity}, {"password", network.EAP.Password}, {"phase2", network.EAP.Phase2}} {
+			if strings.ContainsAny(field.value, "\"\n") {
+				v.add(v.at(append(path, "eap", field.key)...), "wireless network %q: %s may not contain double quotes or line breaks", ssid, field.key)
+			}
+		}
+		if network.EAP.CACert != "" && !fileExists(filepath.Dir(v.file), network.EAP.CACert) {
+			v.add(v.at(append(path, "eap", "ca_cert")...), "wireless network %q: %s does not exist", ssid, network.EAP.CACert)
+		}
+
+		if network.PSK == "" {
+			continue
+		}
+		node := v.at(append(path, "psk")...)
+		switch {
+		case keyMgmt != KeyMgmtSAE && hexPSKPattern.MatchString(network.PSK):
+		case keyMgmt != KeyMgmtSAE && (len(network.PSK) < 8 || len(network.PSK) > 63):
+			v.add(node, "wireless network %q: passphrases are 8 to 63 characters long", ssid)
+		case strings.IndexFunc(network.PSK, func(r rune) bool { return r < 0x20 || r > 0x7e }) >= 0:
+			v.add(node, "wireless network %q: passphrases may only contain printable ASCII characters", ssid)
+		case !network.UsesPSKRaw() && strings.Contains(network.PSK, `"`):
+			v.add(node, "wireless network %q: passphrases of %s networks may not contain double quotes; use psk_secret instead", ssid, KeyMgmtSAE)
+		}
+	}
+}
+
+func (v *validation) checkNetwork(network NetworkingConfig) {
+	for name, iface := range network.Interfaces {
+		path := []string{"network", "interfaces", name}
+		for i, address := range iface.Addresses {
+			if _, err := netip.ParsePrefix(address); err != nil {
+				v.add(v.at(append(path, "addresses", strconv.Itoa(i))...), "network interface %q: %q is not an address with a prefix length, e.g. 192.168.10.5/24", name, address)
+			}
+		}
+		for _, field := range []struct {
+			key       string
+			addresses []string
+		}{{"gateways", iface.Gateways}, {"dns", iface.DNS}} {
+			for i, address := range field.addresses {
+				if _, err := netip.ParseAddr(address); err != nil {
+					v.add(v.at(append(path, field.key, strconv.Itoa(i))...), "network interface %q: %q is not an IP address", name, address)
+				}
+			}
+		}
+
+		if !iface.IsVLAN() {
+			continue
+		}
+		if len(name) > 15 || strings.ContainsAny(name, "*?[/ ") {
+			v.add(v.lookup(path, true), "network interface %q: VLAN names are at most 15 characters long, without globs", name)
+		}
+		parent, ok := network.Interfaces[iface.VLAN.Parent]
+		switch {
+		case !ok:
+			v.add(v.at(append(path, "vlan", "parent")...), "network interface %q: the parent %q is not listed under network.interfaces", name, iface.VLAN.Parent)
+		case parent.IsVLAN():
+			v.add(v.at(append(path, "vlan", "parent")...), "network interface %q: VLANs cannot be on other VLANs", name)
+		}
+	}
+}
+
+func (v *validation) checkCompose(stacks ComposeStacks) {
+	configDir := filepath.Dir(v.file)
+	list := v.at("docker_compose").Kind == yaml.SequenceNode
+	for i, stack := range stacks {
+		path := []string{"docker_compose"}
+		if list {
+			path = append(path, strconv.Itoa(i))
+		}
+		if !stack.Enabled {
+			continue
+		}
+
+		missing := false
+		if stack.Path != "" && !fileExists(configDir, stack.Path) {
+			v.add(v.at(append(path, "path")...), "compose file %s does not exist", stack.Path)
+			missing = true
+		}
+		for j, file := range stack.Files {
+			if !fileExists(configDir, file) {
+				v.add(v.at(append(path, "files", strconv.Itoa(j))...), "compose file %s does not exist", file)
+				missing = true
+			}
+		}
+		paths := resolvePaths(configDir, stack.ComposeFiles())
+		if missing || len(paths) == 0 {
+			continue
+		}
+
+		name := stack.Name
+		if name == "" {
+			name = defaultStackName
+		}
+		options, err := cli.NewProjectOptions(paths,
+			cli.WithName("sprout-"+name),
+			cli.WithInterpolation(false),
+			cli.WithConsistency(false),
+			cli.WithoutEnvironmentResolution,
+		)
+		if err == nil {
+			_, err = options.LoadProject(context.Background())
+		}
+		if err != nil {
+			v.add(v.at(path...), "compose project does not load: %v", err)
+		}
+	}
+}
+
+func fileExists(baseDir, path string) bool {
+	_, err := os.Stat(resolvePaths(baseDir, []string{path})[0])
+	return err == nil
+}
@@ -0,0 +1,130 @@
+package nix
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const validKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGhBgDfImfTT4FQX6feRvOtkFJWPswFo7EG5VGjYDOs4"
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		device string
+		// want are the problems expected, as "line:column: " followed by
+		// the start of the message, with 0:0 for problems without position
+		want []string
+	}{
+		{
+			name:   "valid",
+			config: "ssh_keys:\n  - " + validKey + "\n",
+		},
+		{
+			name:   "unknown field",
+			config: "ssh_keys:\n  - " + validKey + "\nwireles:\n  enabled: true\n",
+			want:   []string{`3:1: unknown field "wireles"`},
+		},
+		{
+			name:   "unknown nested field",
+			config: "wireless:\n  enabled: true\n  country: DE\n  netwroks: {}\n",
+			want:   []string{`4:3: unknown field "netwroks"`},
+		},
+		{
+			name:   "bad SSH key",
+			config: "ssh_keys:\n  - " + validKey + "\n  - ssh-ed25519 AAAAnotakey\n",
+			want:   []string{"3:5: ssh_keys[1]: the key is not valid base64"},
+		},
+		{
+			name:   "short passphrase",
+			config: "wireless:\n  enabled: true\n  networks:\n    Home:\n      psk: short\n",
+			want:   []string{`5:12: wireless network "Home": passphrases are 8 to 63 characters long`},
+		},
+		{
+			name:   "long passphrase",
+			config: "wireless:\n  enabled: true\n  networks:\n    - ssid: Home\n      psk: " + strings.Repeat("x", 64) + "\n",
+			want:   []string{`5:12: wireless network "Home": passphrases are 8 to 63 characters long`},
+		},
+		{
+			name:   "raw PSK",
+			config: "wireless:\n  enabled: true\n  networks:\n    Home:\n      psk: " + strings.Repeat("0f", 32) + "\n",
+		},
+		{
+			name:   "long SAE password",
+			config: "wireless:\n  enabled: true\n  networks:\n    - ssid: Home\n      key_mgmt: SAE\n      psk: " + strings.Repeat("a", 100) + "\n",
+		},
+		{
+			name:   "quote in a hashed passphrase",
+			config: "wireless:\n  enabled: true\n  networks:\n    Home:\n      psk: 'say \"hi\" now'\n",
+		},
+		{
+			name:   "quote in an SAE passphrase",
+			config: "wireless:\n  enabled: true\n  networks:\n    - ssid: Home\n      key_mgmt: SAE\n      psk: 'say \"hi\" now'\n",
+			want:   []string{`6:12: wireless network "Home": passphrases of SAE networks may not contain double quotes`},
+		},
+		{
+			name:   "unknown device",
+			config: "devices:\n  kiosk-1:\n    hostname: kiosk\n",
+			device: "kiosk-2",
+			want:   []string{`0:0: no device named "kiosk-2" in devices`},
+		},
+		{
+			name:   "invalid device name",
+			config: "devices:\n  \"kiosk 1\":\n    hostname: kiosk\n",
+			want:   []string{`2:3: device "kiosk 1": names may only contain`},
+		},
+		{
+			name:   "device name is no hostname",
+			config: "devices:\n  kiosk_1: {}\n",
+			want:   []string{`2:3: device "kiosk_1": the name is not a valid hostname`},
+		},
+		{
+			name:   "problem in device override",
+			config: "devices:\n  kiosk-1:\n    ssh_keys:\n      - not-a-key\n",
+			want:   []string{"4:9: ssh_keys[0]: 'not-a-key' does not match pattern"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "sprout.yaml")
+			if err := os.WriteFile(filename, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			n := &Nix{Device: tt.device}
+			err := n.Validate(filename)
+			var validationErr *ValidationError
+			if err != nil && !errors.As(err, &validationErr) {
+				t.Fatalf("Validate() error = %v, want a ValidationError", err)
+			}
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("Validate() = %v, want no problems", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() found no problems, want %q", tt.want)
+			}
+
+			var got []string
+			for _, problem := range validationErr.Problems {
+				got = append(got, fmt.Sprintf("%d:%d: %s", problem.Line, problem.Column, problem.Message))
+			}
+			for _, want := range tt.want {
+				found := false
+				for _, problem := range got {
+					found = found || strings.HasPrefix(problem, want)
+				}
+				if !found {
+					t.Errorf("Validate() problems = %q, want one starting with %q", got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package nix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// defaultTestMemory is the memory of the test machine in MiB.
+const defaultTestMemory = 2048
+
+// normalize fills in defaults and checks the test settings.
+func (c *TestConfig) normalize() error {
+	if c.Memory == 0 {
+		c.Memory = defaultTestMemory
+	}
+	if c.Memory < 512 {
+		return fmt.Errorf("test.memory must be at least 512 MiB")
+	}
+	for _, port := range c.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid test.ports entry %d", port)
+		}
+	}
+	return nil
+}
+
+// pythonString quotes s as a Python string literal inside a Nix indented
+// string.
+func pythonString(s string) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(s); err != nil {
+		return "", err
+	}
+	quoted := strings.TrimSuffix(buf.String(), "\n")
+	quoted = strings.ReplaceAll(quoted, "''", "'''")
+	return strings.ReplaceAll(quoted, "${", "''${"), nil
+}
+
+// nixString quotes s as a Nix string literal.
+func nixString(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`)
+	return `"` + replacer.Replace(s) + `"`
+}
+
+// RunTest boots the system of the given Nix file in a NixOS test VM and
+// checks that it comes up as configured. The VM runs without KVM if it is
+// not available.
+func (n *Nix) RunTest(filename string, sproutFile *SproutFile) error {
+	isDisabled := os.Getenv("SPROUT_DISABLE_LOCAL_NIX") != ""
+	nixPath, hasNix := exec.LookPath("nix-build")
+
+	if !isDisabled && hasNix == nil {
+		fmt.Printf("      \033[36mUsing local Nix installation...\033[0m\n")
+		return n.runTestLocal(nixPath, filename)
+	}
+
+	fmt.Printf("      \033[36mNix not found locally, using Docker...\033[0m\n")
+	return n.runTestWithDocker(filename, sproutFile)
+}
+
+func (n *Nix) runTestLocal(nixPath, filename string) error {
+	absNixFile, err := filepath.Abs(filename)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	cmd := exec.Command(nixPath, "--cores", "0", "--max-jobs", "auto", "--no-link", "-A", "test.driver", absNixFile)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to build test driver: %w", err)
+	}
+	driver, err := n.extractNixStorePath(string(output))
+	if err != nil {
+		return err
+	}
+
+	// The driver keeps the machine's state in its working directory
+	workDir, err := os.MkdirTemp("", "sprout-test-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	test := exec.Command(filepath.Join(driver, "bin", "nixos-test-driver"))
+	test.Dir = workDir
+	test.Stdout = os.Stdout
+	test.Stderr = os.Stderr
+	if err := test.Run(); err != nil {
+		return fmt.Errorf("test failed: %w", err)
+	}
+	return nil
+}
+
+func (n *Nix) runTestWithDocker(filename string, sproutFile *SproutFile) error {
+	tempDir, nixFileInTemp, err := n.prepareDockerBuildDir(filename, sproutFile)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := n.copyDockerImages(sproutFile, tempDir, nixFileInTemp); err != nil {
+		return err
+	}
+
+	n.printDockerBuildInfo()
+
+	script := `set -e
+driver=$(nix-build --cores 0 --max-jobs auto --no-link -A test.driver /workspace/image.nix)
+mkdir -p /tmp/sprout-test
+cd /tmp/sprout-test
+"$driver/bin/nixos-test-driver"`
+	if _, err := n.runBuilderScript(tempDir, script); err != nil {
+		return fmt.Errorf("test failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package nix
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	KeyMgmtWPAPSK = "WPA-PSK"
+	KeyMgmtSAE    = "SAE"
+	KeyMgmtWPAEAP = "WPA-EAP"
+)
+
+// wirelessCertDir is where the CA certificates of enterprise networks are
+// installed, relative to /etc.
+const wirelessCertDir = "sprout/wireless"
+
+type EAPConfig struct {
+	Method         string `yaml:"method" doc:"EAP method" schema:"enum=PEAP,TTLS;default=PEAP"`
+	Identity       string `yaml:"identity" doc:"Identity (username) to log in with" schema:"required;examples=[\"jane@example.com\"]"`
+	Password       string `yaml:"password" doc:"Password to log in with. It ends up in the world-readable Nix store; use password_secret to keep it out"`
+	PasswordSecret string `yaml:"password_secret" doc:"Name of a secret in the secrets file holding the password. It is written to the root filesystem after the build instead of the Nix store"`
+	Phase2         string `yaml:"phase2" doc:"Inner authentication" schema:"default=auth=MSCHAPV2;examples=[\"auth=MSCHAPV2\", \"auth=PAP\"]"`
+	CACert         string `yaml:"ca_cert" doc:"CA certificate file the server's certificate is checked against (relative to sprout.yaml or absolute)" schema:"examples=[\"certs/radius-ca.pem\"]"`
+	CACertContent  string
+}
+
+type NetworkConfig struct {
+	SSID      string    `yaml:"ssid" doc:"Name of the network, when networks is a list"`
+	PSK       string    `yaml:"psk" doc:"Pre-shared key (password) for the network. It is hashed with the SSID before it is written to the image, except with key_mgmt SAE, which needs the password itself"`
+	PSKSecret string    `yaml:"psk_secret" doc:"Name of a secret in the secrets file holding the pre-shared key. It is written to the root filesystem after the build instead of the Nix store"`
+	KeyMgmt   string    `yaml:"key_mgmt" doc:"Authentication: 'WPA-PSK' (WPA2), 'SAE' (WPA3) or 'WPA-EAP' (WPA2-Enterprise). By default the network may use any of them, with eap credentials for WPA-EAP" schema:"enum=WPA-PSK,SAE,WPA-EAP"`
+	EAP       EAPConfig `yaml:"eap" doc:"Credentials of a WPA2-Enterprise network"`
+	Hidden    bool      `yaml:"hidden" doc:"The network does not broadcast its SSID, so it is probed for" schema:"default=false"`
+	Priority  int       `yaml:"priority" doc:"Networks with a higher priority are preferred. In a list, defaults to the position, earlier networks first"`
+	BSSID     string    `yaml:"bssid" doc:"Only connect to the access point with this MAC address" schema:"pattern=^([0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}$;examples=[\"02:00:5e:10:00:01\"]"`
+}
+
+// KeyManagement returns key_mgmt, or the protocol the network's credentials
+// are for.
+func (c NetworkConfig) KeyManagement() string {
+	switch {
+	case c.KeyMgmt != "":
+		return c.KeyMgmt
+	case c.EAP.Identity != "":
+		return KeyMgmtWPAEAP
+	}
+	return KeyMgmtWPAPSK
+}
+
+// UsesPSKRaw reports whether the network's PSK is written as a raw key, so
+// the passphrase stays out of the Nix store. Only SAE networks keep the
+// passphrase, since SAE needs it itself.
+func (c NetworkConfig) UsesPSKRaw() bool {
+	return c.PSK != "" && c.KeyMgmt != KeyMgmtSAE
+}
+
+// PSKRaw returns the PSK derived from the passphrase and SSID, as
+// wpa_passphrase does, so that the passphrase is not written to the image.
+func (c NetworkConfig) PSKRaw() (string, error) {
+	if hexPSKPattern.MatchString(c.PSK) {
+		return c.PSK, nil
+	}
+	key, err := pbkdf2.Key(sha1.New, c.PSK, []byte(c.SSID), 4096, 32)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// CACertFile returns where the network's CA certificate is installed,
+// relative to /etc, or "" if it has none. index is the network's position.
+func (c NetworkConfig) CACertFile(index int) string {
+	if c.EAP.CACert == "" {
+		return ""
+	}
+	return path.Join(wirelessCertDir, fmt.Sprintf("ca-%d.pem", index))
+}
+
+// EAPSettings returns the wpa_supplicant settings of an enterprise network.
+func (c NetworkConfig) EAPSettings(index int) []string {
+	eap := c.EAP
+	settings := []string{
+		"eap=" + eap.Method,
+		`identity="` + eap.Identity + `"`,
+	}
+	if eap.PasswordSecret != "" {
+		settings = append(settings, "password=ext:"+eap.PasswordSecret)
+	} else {
+		settings = append(settings, `password="`+eap.Password+`"`)
+	}
+	if file := c.CACertFile(index); file != "" {
+		settings = append(settings, `ca_cert="/etc/`+file+`"`)
+	}
+	return append(settings, `phase2="`+eap.Phase2+`"`)
+}
+
+func (e *EAPConfig) normalize() {
+	if e.Method == "" {
+		e.Method = "PEAP"
+	}
+	if e.Phase2 == "" {
+		e.Phase2 = "auth=MSCHAPV2"
+	}
+}
+
+// WirelessNetworks are either a map of SSID to network, or a list of
+// networks in order of preference.
+type WirelessNetworks []NetworkConfig
+
+func (w *WirelessNetworks) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		var byName map[string]NetworkConfig
+		if err := node.Decode(&byName); err != nil {
+			return err
+		}
+		networks := make(WirelessNetworks, 0, len(byName))
+		for ssid, network := range byName {
+			network.SSID = ssid
+			networks = append(networks, network)
+		}
+		slices.SortFunc(networks, func(a, b NetworkConfig) int {
+			return strings.Compare(a.SSID, b.SSID)
+		})
+		*w = networks
+		return nil
+	}
+
+	networks := make(WirelessNetworks, len(node.Content))
+	for i, item := range node.Content {
+		if err := item.Decode(&networks[i]); err != nil {
+			return err
+		}
+		// Earlier networks are preferred unless they say otherwise
+		if mappingValue(item, "priority") == nil {
+			networks[i].Priority = len(node.Content) - i
+		}
+	}
+	*w = networks
+	return nil
+}
+
+type WirelessConfig struct {
+	Enabled  bool             `yaml:"enabled" doc:"Enable wireless networking" schema:"default=false"`
+	Country  string           `yaml:"country" doc:"ISO 3166 country code, which decides the channels and transmit power allowed" schema:"pattern=^[A-Z]{2}$;examples=[\"US\", \"DE\"]"`
+	Networks WirelessNetworks `yaml:"networks" doc:"Map of SSID to network configuration, or a list of networks with their ssid in order of preference" schema:"examples=[{\"MyWiFi\": {\"psk\": \"password123\"}, \"WorkNetwork\": {\"psk\": \"different-password\"}}, [{\"ssid\": \"Office\", \"key_mgmt\": \"WPA-EAP\", \"eap\": {\"identity\": \"jane@example.com\", \"password_secret\": \"office_wifi\"}}, {\"ssid\": \"Backup\", \"psk\": \"different-password\", \"hidden\": true}]]"`
+}
+
+// normalize applies defaults and reads the CA certificates of enterprise
+// networks.
+func (w *WirelessConfig) normalize(configDir string) error {
+	for i := range w.Networks {
+		network := &w.Networks[i]
+		network.EAP.normalize()
+		if network.EAP.CACert == "" {
+			continue
+		}
+		data, err := os.ReadFile(resolvePaths(configDir, []string{network.EAP.CACert})[0])
+		if err != nil {
+			return fmt.Errorf("failed to read the CA certificate of wireless network %q: %w", network.SSID, err)
+		}
+		network.EAP.CACertContent = string(data)
+	}
+	return nil
+}
+
+// secretNames returns the secrets the networks read their keys and
+// passwords from.
+func (w WirelessConfig) secretNames() []string {
+	var names []string
+	for _, network := range w.Networks {
+		for _, name := range []string{network.PSKSecret, network.EAP.PasswordSecret} {
+			if name != "" && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
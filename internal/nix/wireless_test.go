@@ -0,0 +1,71 @@
+package nix
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Networks given as a map predate key_mgmt. Their passphrases are hashed
+// like those of any network without key_mgmt SAE, and they keep the
+// default authentication protocols.
+func TestWirelessMapFormKeepsDefaults(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "sprout.yaml")
+	err := os.WriteFile(config, []byte(`wireless:
+  enabled: true
+  networks:
+    IEEE:
+      psk: "password"
+    ThisIsASSID:
+      psk: "ThisIsAPassword"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := &Nix{}
+	sproutFile, err := n.LoadConfigOnly(config)
+	if err != nil {
+		t.Fatalf("LoadConfigOnly() error = %v", err)
+	}
+	image, err := n.GenerateImage(*sproutFile)
+	if err != nil {
+		t.Fatalf("GenerateImage() error = %v", err)
+	}
+
+	// The test vectors of IEEE 802.11i
+	want := `      networking.wireless.networks = {
+        "IEEE" = {
+          pskRaw = "f42c6fc52df0ebef9ebb4b90b38a5f902e83fe1b135a70e23aed762e9710a12e";
+        };
+        "ThisIsASSID" = {
+          pskRaw = "0dc0d6eb90555ed6419756b9a15ec3e3209b63df707dd508d14581f8982721af";
+        };
+      };
+`
+	if !strings.Contains(image, want) {
+		t.Errorf("GenerateImage() does not contain\n%s", want)
+	}
+	if strings.Contains(image, "authProtocols") {
+		t.Error("GenerateImage() restricts authProtocols without key_mgmt")
+	}
+}
+
+func TestWirelessPSKOnlyInPlainForSAE(t *testing.T) {
+	tests := []struct {
+		keyMgmt string
+		raw     bool
+	}{
+		{"", true},
+		{KeyMgmtWPAPSK, true},
+		{KeyMgmtSAE, false},
+	}
+	for _, tt := range tests {
+		network := NetworkConfig{SSID: "Home", PSK: "correct horse battery", KeyMgmt: tt.keyMgmt}
+		if got := network.UsesPSKRaw(); got != tt.raw {
+			t.Errorf("UsesPSKRaw() with key_mgmt %q = %t, want %t", tt.keyMgmt, got, tt.raw)
+		}
+	}
+}
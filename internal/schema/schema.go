@@ -0,0 +1,318 @@
+// Package schema derives JSON schemas from Go types.
+//
+// Properties are named by their yaml tags; fields without one are not part
+// of the file format and are left out. Structs do not allow unknown
+// properties. Fields are annotated with two more tags:
+//
+//	doc:"Description of the setting"
+//	schema:"required;enum=a,b;default=a;minimum=1;maximum=9;minItems=1;pattern=^x$;examples=[\"a\"]"
+//
+// enum, pattern, minimum and maximum constrain the elements of slices
+// rather than the slice itself. Types that need more than that, such as
+// alternatives, implement Extender.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Schema is a draft-07 JSON schema.
+type Schema struct {
+	Schema               string      `json:"$schema,omitempty"`
+	ID                   string      `json:"$id,omitempty"`
+	Ref                  string      `json:"$ref,omitempty"`
+	Title                string      `json:"title,omitempty"`
+	Description          string      `json:"description,omitempty"`
+	Type                 string      `json:"type,omitempty"`
+	Properties           *Properties `json:"properties,omitempty"`
+	Items                *Schema     `json:"items,omitempty"`
+	AdditionalProperties any         `json:"additionalProperties,omitempty"`
+	Required             []string    `json:"required,omitempty"`
+	Enum                 []any       `json:"enum,omitempty"`
+	Const                any         `json:"const,omitempty"`
+	Default              any         `json:"default,omitempty"`
+	Minimum              *float64    `json:"minimum,omitempty"`
+	Maximum              *float64    `json:"maximum,omitempty"`
+	MinItems             *int        `json:"minItems,omitempty"`
+	Pattern              string      `json:"pattern,omitempty"`
+	Examples             []any       `json:"examples,omitempty"`
+	OneOf                []*Schema   `json:"oneOf,omitempty"`
+	AnyOf                []*Schema   `json:"anyOf,omitempty"`
+	AllOf                []*Schema   `json:"allOf,omitempty"`
+	If                   *Schema     `json:"if,omitempty"`
+	Then                 *Schema     `json:"then,omitempty"`
+	Definitions          *Properties `json:"definitions,omitempty"`
+}
+
+// Properties are named schemas kept in the order they were added.
+type Properties struct {
+	names   []string
+	schemas map[string]*Schema
+}
+
+// Set adds or replaces a property.
+func (p *Properties) Set(name string, s *Schema) {
+	if p.schemas == nil {
+		p.schemas = make(map[string]*Schema)
+	}
+	if _, ok := p.schemas[name]; !ok {
+		p.names = append(p.names, name)
+	}
+	p.schemas[name] = s
+}
+
+// Get returns the named property, or nil.
+func (p *Properties) Get(name string) *Schema {
+	return p.schemas[name]
+}
+
+func (p *Properties) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range p.names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := encode(name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := encode(p.schemas[name])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Extender is implemented by types that adjust the schema generated for
+// them.
+type Extender interface {
+	ExtendSchema(s *Schema, g *Generator) error
+}
+
+// Generator builds the schema of a type and of the types it refers to.
+type Generator struct {
+	definitions Properties
+	defined     map[reflect.Type]string
+}
+
+// Generate returns the schema of v's type, with the definitions referred
+// to by Ref.
+func (g *Generator) Generate(v any) (*Schema, error) {
+	s, err := g.For(reflect.TypeOf(v))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.definitions.names) > 0 {
+		s.Definitions = &g.definitions
+	}
+	return s, nil
+}
+
+// Ref returns a reference to the schema of t, added to the definitions
+// under name the first time.
+func (g *Generator) Ref(t reflect.Type, name string) (*Schema, error) {
+	if g.defined == nil {
+		g.defined = make(map[reflect.Type]string)
+	}
+	if _, ok := g.defined[t]; !ok {
+		g.defined[t] = name
+		s, err := g.generate(t)
+		if err != nil {
+			return nil, err
+		}
+		g.definitions.Set(name, s)
+	}
+	return &Schema{Ref: "#/definitions/" + g.defined[t]}, nil
+}
+
+// For returns the schema of t.
+func (g *Generator) For(t reflect.Type) (*Schema, error) {
+	if name, ok := g.defined[t]; ok {
+		return &Schema{Ref: "#/definitions/" + name}, nil
+	}
+	return g.generate(t)
+}
+
+var extenderType = reflect.TypeFor[Extender]()
+
+func (g *Generator) generate(t reflect.Type) (*Schema, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	s := &Schema{}
+	switch t.Kind() {
+	case reflect.String:
+		s.Type = "string"
+	case reflect.Bool:
+		s.Type = "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s.Type = "integer"
+	case reflect.Float32, reflect.Float64:
+		s.Type = "number"
+	case reflect.Slice, reflect.Array:
+		items, err := g.For(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		s.Type = "array"
+		s.Items = items
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("map keys of %s are not strings", t)
+		}
+		values, err := g.For(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		s.Type = "object"
+		s.AdditionalProperties = values
+	case reflect.Struct:
+		if err := g.generateStruct(t, s); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("no schema for %s", t)
+	}
+
+	if t.Implements(extenderType) {
+		if err := reflect.Zero(t).Interface().(Extender).ExtendSchema(s, g); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (g *Generator) generateStruct(t reflect.Type, s *Schema) error {
+	s.Type = "object"
+	s.Properties = &Properties{}
+	s.AdditionalProperties = false
+
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || name == "" || name == "-" {
+			continue
+		}
+
+		property, err := g.For(field.Type)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", t.Name(), field.Name, err)
+		}
+		if property.Ref != "" && field.Tag.Get("doc") != "" {
+			property = &Schema{AllOf: []*Schema{property}}
+		}
+		property.Description = field.Tag.Get("doc")
+
+		required, err := applyTag(property, field.Tag.Get("schema"))
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", t.Name(), field.Name, err)
+		}
+		if required {
+			s.Required = append(s.Required, name)
+		}
+		s.Properties.Set(name, property)
+	}
+	return nil
+}
+
+// applyTag applies the constraints of a schema tag and reports whether the
+// property is required.
+func applyTag(s *Schema, tag string) (bool, error) {
+	required := false
+	if tag == "" {
+		return false, nil
+	}
+
+	// Value constraints of slices apply to their elements
+	element := s
+	if s.Type == "array" && s.Items != nil {
+		element = s.Items
+	}
+
+	for _, option := range strings.Split(tag, ";") {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "required":
+			required = true
+		case "enum":
+			for _, v := range strings.Split(value, ",") {
+				element.Enum = append(element.Enum, v)
+			}
+		case "default":
+			s.Default = parseValue(value)
+		case "pattern":
+			element.Pattern = value
+		case "minimum", "maximum":
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return false, fmt.Errorf("invalid %s %q", key, value)
+			}
+			if key == "minimum" {
+				element.Minimum = &n
+			} else {
+				element.Maximum = &n
+			}
+		case "minItems":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return false, fmt.Errorf("invalid minItems %q", value)
+			}
+			s.MinItems = &n
+		case "examples":
+			if err := json.Unmarshal([]byte(value), &s.Examples); err != nil {
+				return false, fmt.Errorf("invalid examples: %w", err)
+			}
+		default:
+			return false, fmt.Errorf("unknown schema option %q", key)
+		}
+	}
+	return required, nil
+}
+
+// parseValue reads a default as JSON, or as a string if it is not JSON.
+func parseValue(value string) any {
+	var v any
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		return value
+	}
+	return v
+}
+
+// Marshal formats a schema for writing to a file.
+func Marshal(s *Schema) ([]byte, error) {
+	data, err := encode(s)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// encode marshals v without escaping HTML characters, which are common in
+// descriptions.
+func encode(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
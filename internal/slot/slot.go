@@ -0,0 +1,200 @@
+// Package slot installs root images on devices with an A/B partition
+// layout and falls back to the previous slot when a new one does not boot.
+//
+// The card holds the firmware partition, two root slots and a data
+// partition. U-Boot boots the slot with the bootable flag set, and NixOS
+// mounts the root filesystem labelled NIXOS_SD, so switching slots moves
+// both the flag and the label.
+package slot
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// RootLabel is the filesystem label NixOS mounts as the root.
+	RootLabel = "NIXOS_SD"
+	// spareLabel marks the root filesystem of the inactive slot.
+	spareLabel = "SPROUT_SLOT"
+
+	firstSlot  = 2
+	secondSlot = 3
+
+	// readonlyRootMount is where the root partition is mounted when the
+	// root filesystem is a tmpfs.
+	readonlyRootMount = "/sprout/root"
+
+	sectorSize = 512
+	// mbrTableOffset is where the four partition entries start.
+	mbrTableOffset = 446
+)
+
+// Device is the card the running system booted from.
+type Device struct {
+	// Disk is the block device name of the card, e.g. mmcblk0.
+	Disk string
+	// Current is the partition number of the running slot.
+	Current int
+}
+
+// Detect finds the card and slot the root filesystem is mounted from.
+func Detect() (*Device, error) {
+	source, err := rootSource()
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(source)
+
+	current, err := readSysInt(filepath.Join("/sys/class/block", name, "partition"))
+	if err != nil {
+		return nil, fmt.Errorf("root device %s is not a partition: %w", name, err)
+	}
+	if current != firstSlot && current != secondSlot {
+		return nil, fmt.Errorf("root is on partition %d, expected an A/B layout with slots on partitions %d and %d", current, firstSlot, secondSlot)
+	}
+
+	link, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the disk of %s: %w", name, err)
+	}
+
+	return &Device{Disk: filepath.Base(filepath.Dir(link)), Current: current}, nil
+}
+
+// rootSource returns the device the root partition is mounted from. With a
+// read-only root, / is a tmpfs and the partition is mounted elsewhere.
+func rootSource() (string, error) {
+	for _, mount := range []string{"/", readonlyRootMount} {
+		output, err := exec.Command("findmnt", "--noheadings", "--output", "SOURCE", mount).Output()
+		source := strings.TrimSpace(string(output))
+		if err == nil && strings.HasPrefix(source, "/dev/") {
+			return source, nil
+		}
+	}
+	return "", errors.New("failed to find the root device")
+}
+
+// Other returns the partition number of the inactive slot.
+func (d *Device) Other() int {
+	if d.Current == firstSlot {
+		return secondSlot
+	}
+	return firstSlot
+}
+
+// Partition returns the device path of partition n of the card.
+func (d *Device) Partition(n int) (string, error) {
+	entries, err := os.ReadDir(filepath.Join("/sys/class/block", d.Disk))
+	if err != nil {
+		return "", fmt.Errorf("failed to list partitions of %s: %w", d.Disk, err)
+	}
+	for _, entry := range entries {
+		number, err := readSysInt(filepath.Join("/sys/class/block", d.Disk, entry.Name(), "partition"))
+		if err == nil && number == n {
+			return "/dev/" + entry.Name(), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no partition %d", d.Disk, n)
+}
+
+// partitionSize returns the size of partition n in bytes.
+func (d *Device) partitionSize(n int) (int64, error) {
+	path, err := d.Partition(n)
+	if err != nil {
+		return 0, err
+	}
+	sectors, err := readSysInt(filepath.Join("/sys/class/block", filepath.Base(path), "size"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the size of %s: %w", path, err)
+	}
+	return int64(sectors) * sectorSize, nil
+}
+
+// activate makes slot the one booted next, and other the spare.
+func (d *Device) activate(slot, other int) error {
+	slotPath, err := d.Partition(slot)
+	if err != nil {
+		return err
+	}
+	otherPath, err := d.Partition(other)
+	if err != nil {
+		return err
+	}
+
+	// Relabel the new root first: a card without a NIXOS_SD filesystem
+	// does not boot at all
+	if err := setLabel(slotPath, RootLabel); err != nil {
+		return err
+	}
+	if err := setLabel(otherPath, spareLabel); err != nil {
+		return err
+	}
+	return d.setBootable(slot)
+}
+
+// setBootable sets the bootable flag on partition n only.
+func (d *Device) setBootable(n int) error {
+	disk, err := os.OpenFile("/dev/"+d.Disk, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", d.Disk, err)
+	}
+	defer disk.Close()
+
+	mbr := make([]byte, sectorSize)
+	if _, err := disk.ReadAt(mbr, 0); err != nil {
+		return fmt.Errorf("failed to read the partition table of %s: %w", d.Disk, err)
+	}
+	if err := checkMBR(mbr); err != nil {
+		return err
+	}
+	markBootable(mbr, n)
+	if _, err := disk.WriteAt(mbr, 0); err != nil {
+		return fmt.Errorf("failed to write the partition table of %s: %w", d.Disk, err)
+	}
+	return disk.Sync()
+}
+
+// markBootable sets the bootable flag of partition n in the DOS partition
+// table mbr, and clears it on the others.
+func markBootable(mbr []byte, n int) {
+	for i := 0; i < 4; i++ {
+		flag := byte(0)
+		if i+1 == n {
+			flag = 0x80
+		}
+		mbr[mbrTableOffset+16*i] = flag
+	}
+}
+
+// checkMBR checks that sector is a DOS partition table.
+func checkMBR(sector []byte) error {
+	if binary.LittleEndian.Uint16(sector[510:]) != 0xaa55 {
+		return errors.New("no DOS partition table found")
+	}
+	return nil
+}
+
+// setLabel changes the label of an ext4 filesystem. e2label uses an ioctl
+// when the filesystem is mounted, so this is safe for the running root.
+func setLabel(device, label string) error {
+	output, err := exec.Command("e2label", device, label).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to label %s as %s: %w\nOutput: %s", device, label, err, output)
+	}
+	return nil
+}
+
+func readSysInt(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
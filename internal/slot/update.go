@@ -0,0 +1,288 @@
+package slot
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// statePath lives on the data partition, so both slots see it.
+var statePath = "/persist/sprout/slot.json"
+
+const (
+	// configPath is written by the image with the layout settings.
+	configPath = "/etc/sprout/layout.json"
+	// healthUnitsPath lists the units that have to be active for a slot to
+	// be kept.
+	healthUnitsPath = "/etc/sprout/health-units"
+
+	// rootPartition is the partition of a built image holding the root
+	// filesystem.
+	rootPartition = 2
+
+	ext4SuperblockOffset = 1024
+	ext4Magic            = 0xef53
+)
+
+// Config holds the layout settings from sprout.yaml.
+type Config struct {
+	BootAttempts int `json:"boot_attempts"`
+}
+
+// LoadConfig reads the layout settings of the running image.
+func LoadConfig() (Config, error) {
+	config := Config{BootAttempts: 3}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return config, fmt.Errorf("failed to read %s: %w", configPath, err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse %s: %w", configPath, err)
+	}
+	return config, nil
+}
+
+// State tracks a slot that has been installed but not confirmed yet.
+type State struct {
+	// Trial is the slot being tried, or 0.
+	Trial int `json:"trial,omitempty"`
+	// Fallback is the slot to go back to if Trial fails.
+	Fallback int `json:"fallback,omitempty"`
+	// BootsLeft is how many more times Trial may be booted.
+	BootsLeft int `json:"boots_left,omitempty"`
+	// Failed is the last slot that was abandoned.
+	Failed int `json:"failed,omitempty"`
+}
+
+// LoadState reads the slot state from the data partition.
+func LoadState() (State, error) {
+	var state State
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read slot state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse slot state: %w", err)
+	}
+	return state, nil
+}
+
+func (s State) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0755); err != nil {
+		return fmt.Errorf("failed to create slot state directory: %w", err)
+	}
+	tmp := statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write slot state: %w", err)
+	}
+	if err := os.Rename(tmp, statePath); err != nil {
+		return fmt.Errorf("failed to write slot state: %w", err)
+	}
+	return nil
+}
+
+// Install writes the root filesystem of a Sprout image to the inactive slot
+// and selects it for the next boot. image is read front to back, so it can
+// be streamed. The new slot may fail to boot attempts times before the
+// device falls back to the current one.
+func (d *Device) Install(image io.Reader, attempts int) (int64, error) {
+	slot := d.Other()
+	target, err := d.Partition(slot)
+	if err != nil {
+		return 0, err
+	}
+	slotSize, err := d.partitionSize(slot)
+	if err != nil {
+		return 0, err
+	}
+
+	head, fsSize, err := rootFilesystem(image)
+	if err != nil {
+		return 0, err
+	}
+	if fsSize > slotSize {
+		return 0, fmt.Errorf("root filesystem (%d MiB) does not fit slot %d (%d MiB)", fsSize>>20, slot, slotSize>>20)
+	}
+
+	// Forget a previous attempt before its slot is overwritten
+	state, err := LoadState()
+	if err != nil {
+		return 0, err
+	}
+	state.Trial, state.Fallback, state.BootsLeft = 0, 0, 0
+	if err := state.save(); err != nil {
+		return 0, err
+	}
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_EXCL, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", target, err)
+	}
+	if _, err := out.Write(head); err != nil {
+		out.Close()
+		return 0, fmt.Errorf("failed to write %s: %w", target, err)
+	}
+	if _, err := io.CopyN(out, image, fsSize-int64(len(head))); err != nil {
+		out.Close()
+		return 0, fmt.Errorf("failed to write %s: %w", target, err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return 0, fmt.Errorf("failed to write %s: %w", target, err)
+	}
+	out.Close()
+
+	// The image's root carries the active label; keep it out of the way
+	// until the slot is switched
+	if err := setLabel(target, spareLabel); err != nil {
+		return 0, err
+	}
+
+	state.Trial, state.Fallback, state.BootsLeft = slot, d.Current, attempts
+	if err := state.save(); err != nil {
+		return 0, err
+	}
+	if err := d.activate(slot, d.Current); err != nil {
+		return 0, err
+	}
+	return fsSize, nil
+}
+
+// rootFilesystem reads a Sprout image up to the start of its root
+// filesystem. It returns the first bytes of the filesystem, which image has
+// been read past, and the size of the filesystem. The root partition of a
+// built image may be larger than the filesystem in it; only the filesystem
+// needs to be copied.
+func rootFilesystem(image io.Reader) ([]byte, int64, error) {
+	mbr := make([]byte, sectorSize)
+	if _, err := io.ReadFull(image, mbr); err != nil {
+		return nil, 0, fmt.Errorf("failed to read the image partition table: %w", err)
+	}
+	if err := checkMBR(mbr); err != nil {
+		return nil, 0, fmt.Errorf("not a Sprout image: %w", err)
+	}
+	entry := mbr[mbrTableOffset+16*(rootPartition-1):]
+	start := int64(binary.LittleEndian.Uint32(entry[8:])) * sectorSize
+	if start < sectorSize {
+		return nil, 0, fmt.Errorf("not a Sprout image: there is no partition %d", rootPartition)
+	}
+	if _, err := io.CopyN(io.Discard, image, start-sectorSize); err != nil {
+		return nil, 0, fmt.Errorf("failed to read the image: %w", err)
+	}
+
+	head := make([]byte, 2*ext4SuperblockOffset)
+	if _, err := io.ReadFull(image, head); err != nil {
+		return nil, 0, fmt.Errorf("failed to read the root filesystem: %w", err)
+	}
+	size, err := ext4Size(head[ext4SuperblockOffset:])
+	if err != nil {
+		return nil, 0, err
+	}
+	return head, size, nil
+}
+
+// ext4Size returns the size of the ext4 filesystem with the given
+// superblock.
+func ext4Size(sb []byte) (int64, error) {
+	if binary.LittleEndian.Uint16(sb[56:]) != ext4Magic {
+		return 0, errors.New("the image's root partition is not an ext4 filesystem")
+	}
+	blocks := int64(binary.LittleEndian.Uint32(sb[4:]))
+	// 64bit feature: the high half of the block count is valid
+	if binary.LittleEndian.Uint32(sb[0x60:])&0x80 != 0 {
+		blocks |= int64(binary.LittleEndian.Uint32(sb[0x150:])) << 32
+	}
+	blockSize := int64(1024) << binary.LittleEndian.Uint32(sb[24:])
+	return blocks * blockSize, nil
+}
+
+// Boot counts a boot of a slot on trial. Once it has used up its attempts,
+// the previous slot is restored and the device reboots into it. It returns
+// whether a reboot was started. Boot runs in the slot's own system, so
+// boots that fail before it runs, e.g. a kernel panic, are not counted.
+func (d *Device) Boot() (bool, error) {
+	state, err := LoadState()
+	if err != nil || state.Trial == 0 {
+		return false, err
+	}
+
+	if state.Trial != d.Current {
+		// Booted the other slot after all, e.g. after a manual switch
+		state.Trial, state.Fallback, state.BootsLeft = 0, 0, 0
+		return false, state.save()
+	}
+
+	if state.BootsLeft > 0 {
+		state.BootsLeft--
+		return false, state.save()
+	}
+
+	fmt.Printf("Slot %d did not become healthy, falling back to slot %d\n", state.Trial, state.Fallback)
+	if err := d.activate(state.Fallback, state.Trial); err != nil {
+		return false, err
+	}
+	state = State{Failed: state.Trial}
+	if err := state.save(); err != nil {
+		return false, err
+	}
+	return true, exec.Command("systemctl", "reboot").Run()
+}
+
+// Confirm waits for the system to finish booting. If the running slot is on
+// trial, it is kept when the units Sprout runs came up, and otherwise the
+// device is rebooted, which counts as a failed boot.
+func (d *Device) Confirm(timeout time.Duration) error {
+	state, err := LoadState()
+	if err != nil || state.Trial != d.Current {
+		return err
+	}
+
+	failed, err := failedUnits(timeout)
+	if err != nil {
+		return err
+	}
+	if len(failed) == 0 {
+		fmt.Printf("Slot %d is healthy\n", d.Current)
+		return State{}.save()
+	}
+
+	fmt.Printf("Slot %d is not healthy, %s not running, rebooting (%d boot(s) left)\n", d.Current, strings.Join(failed, ", "), state.BootsLeft)
+	return exec.Command("systemctl", "reboot").Run()
+}
+
+// failedUnits waits up to timeout for the system to finish starting and
+// returns the units listed in healthUnitsPath that are not active. Other
+// units failing does not count against a slot.
+func failedUnits(timeout time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// Reports degraded as an error, which is judged by the units below
+	exec.CommandContext(ctx, "systemctl", "is-system-running", "--wait").Run()
+
+	data, err := os.ReadFile(healthUnitsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the units to check: %w", err)
+	}
+	var failed []string
+	for _, unit := range strings.Fields(string(data)) {
+		if err := exec.Command("systemctl", "is-active", "--quiet", unit).Run(); err != nil {
+			failed = append(failed, unit)
+		}
+	}
+	return failed, nil
+}
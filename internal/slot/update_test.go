@@ -0,0 +1,152 @@
+package slot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testImage returns an image with a DOS partition table whose root
+// partition starts at rootStart bytes and holds an ext4 filesystem of
+// blocks 4 KiB blocks, followed by a trailer that is not part of it.
+func testImage(rootStart int64, blocks uint32) []byte {
+	image := make([]byte, rootStart+2*ext4SuperblockOffset)
+	entry := image[mbrTableOffset+16*(rootPartition-1):]
+	binary.LittleEndian.PutUint32(entry[8:], uint32(rootStart/sectorSize))
+	binary.LittleEndian.PutUint16(image[510:], 0xaa55)
+
+	sb := image[rootStart+ext4SuperblockOffset:]
+	binary.LittleEndian.PutUint32(sb[4:], blocks)
+	binary.LittleEndian.PutUint32(sb[24:], 2)
+	binary.LittleEndian.PutUint16(sb[56:], ext4Magic)
+	copy(image[rootStart:], "head")
+	return append(image, "rest of the filesystem"...)
+}
+
+func TestRootFilesystem(t *testing.T) {
+	const rootStart = 8 * sectorSize
+	image := bytes.NewReader(testImage(rootStart, 3))
+
+	head, size, err := rootFilesystem(image)
+	if err != nil {
+		t.Fatalf("rootFilesystem() error = %v", err)
+	}
+	if size != 3*4096 {
+		t.Errorf("rootFilesystem() size = %d, want %d", size, 3*4096)
+	}
+	if len(head) != 2*ext4SuperblockOffset || !bytes.HasPrefix(head, []byte("head")) {
+		t.Errorf("rootFilesystem() head does not start at the root partition")
+	}
+	rest, _ := io.ReadAll(image)
+	if string(rest) != "rest of the filesystem" {
+		t.Errorf("image is left at %q, want the data after the head", rest)
+	}
+}
+
+func TestRootFilesystemErrors(t *testing.T) {
+	noMBR := testImage(8*sectorSize, 3)
+	noMBR[510] = 0
+
+	noRoot := testImage(8*sectorSize, 3)
+	binary.LittleEndian.PutUint32(noRoot[mbrTableOffset+16*(rootPartition-1)+8:], 0)
+
+	notExt4 := testImage(8*sectorSize, 3)
+	notExt4[8*sectorSize+ext4SuperblockOffset+56] = 0
+
+	truncated := testImage(8*sectorSize, 3)[:8*sectorSize+100]
+
+	tests := []struct {
+		name  string
+		image []byte
+		want  string
+	}{
+		{"no partition table", noMBR, "not a Sprout image"},
+		{"no root partition", noRoot, "there is no partition 2"},
+		{"not ext4", notExt4, "not an ext4 filesystem"},
+		{"truncated", truncated, "failed to read the root filesystem"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := rootFilesystem(bytes.NewReader(tt.image))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("rootFilesystem() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExt4Size64Bit(t *testing.T) {
+	sb := make([]byte, ext4SuperblockOffset)
+	binary.LittleEndian.PutUint16(sb[56:], ext4Magic)
+	binary.LittleEndian.PutUint32(sb[4:], 1)
+	binary.LittleEndian.PutUint32(sb[0x60:], 0x80)
+	binary.LittleEndian.PutUint32(sb[0x150:], 1)
+
+	size, err := ext4Size(sb)
+	if err != nil {
+		t.Fatalf("ext4Size() error = %v", err)
+	}
+	if want := int64(1<<32+1) * 1024; size != want {
+		t.Errorf("ext4Size() = %d, want %d", size, want)
+	}
+}
+
+func TestMarkBootable(t *testing.T) {
+	mbr := testImage(8*sectorSize, 3)[:sectorSize]
+	mbr[mbrTableOffset] = 0x80
+
+	markBootable(mbr, 3)
+	for i := 0; i < 4; i++ {
+		want := byte(0)
+		if i == 2 {
+			want = 0x80
+		}
+		if got := mbr[mbrTableOffset+16*i]; got != want {
+			t.Errorf("partition %d flag = %#x, want %#x", i+1, got, want)
+		}
+	}
+	if err := checkMBR(mbr); err != nil {
+		t.Errorf("checkMBR() after markBootable() = %v", err)
+	}
+}
+
+func TestBoot(t *testing.T) {
+	defer func(path string) { statePath = path }(statePath)
+	tests := []struct {
+		name  string
+		state State
+		want  State
+	}{
+		{"no trial", State{Failed: 3}, State{Failed: 3}},
+		{"counts a boot", State{Trial: 2, Fallback: 3, BootsLeft: 2}, State{Trial: 2, Fallback: 3, BootsLeft: 1}},
+		{"booted the other slot", State{Trial: 3, Fallback: 2, BootsLeft: 1}, State{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statePath = filepath.Join(t.TempDir(), "slot.json")
+			if err := tt.state.save(); err != nil {
+				t.Fatal(err)
+			}
+
+			d := &Device{Disk: "mmcblk0", Current: 2}
+			rebooted, err := d.Boot()
+			if err != nil {
+				t.Fatalf("Boot() error = %v", err)
+			}
+			if rebooted {
+				t.Error("Boot() rebooted")
+			}
+			got, err := LoadState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("state after Boot() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
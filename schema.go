@@ -0,0 +1,12 @@
+// Package sprout holds the files of the repository root that are built
+// into the sprout binary.
+package sprout
+
+import _ "embed"
+
+//go:generate go run ./cmd/sprout schema -o sprout.schema.json
+
+// Schema is the JSON schema of sprout.yaml.
+//
+//go:embed sprout.schema.json
+var Schema []byte